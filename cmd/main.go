@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/hwameistor/drbd-installer/pkg/drbd"
+	"github.com/hwameistor/drbd-installer/pkg/kube"
+	"github.com/hwameistor/drbd-installer/pkg/metrics"
+	"github.com/hwameistor/drbd-installer/pkg/server"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -16,9 +23,66 @@ var (
 	skipError                          = flag.Bool("skip-error", false, "skip when error occur, false by default")
 	debug                              = flag.Bool("debug", true, "debug mode, true by default")
 	block                              = flag.Bool("block-the-pod", false, "block after succeccfully installed drbd kernel mods")
+	httpAddr                           = flag.String("http-addr", "", "address serving /healthz, /readyz, /status and /metrics in reconcile or block mode, e.g. :8080, empty disables it")
+	reconcileInterval                  = flag.Duration("reconcile-interval", 0, "keep running and reinstall DRBD kernel mods drifted on host at this interval, e.g. 5m, 0 disables it")
+	matchPolicy                        = flag.String("match-policy", drbd.MatchPolicySameABI, "policy to match DRBD kernel mods builds with host kernel, one of exact, same-abi, kabi-stream, nearest-lower")
+	maxReleaseDistance                 = flag.Int("match-max-release-distance", 0, "max ABI number distance between host kernel and build for nearest-lower policy, 0 means unlimited")
+	dryRun                             = flag.Bool("dry-run", false, "only print the plan of what would be done to host, without any side effect")
+	statusFormat                       = flag.String("output", drbd.StatusFormatText, "output format of status command and dry-run plan, one of text, json, yaml")
+	checkSymbolCRCs                    = flag.Bool("check-symbol-crcs", false, "check DRBD kernel mods symbol CRCs against host kernel before installing")
+	autoloadBackend                    = flag.String("autoload-backend", drbd.AutoloadBackendAuto, "backend loading DRBD kernel mods on host boot, one of auto, modules-load.d, etc-modules, sysconfig, systemd-unit")
+	installedKernels                   = flag.Bool("installed-kernels", true, "also install DRBD kernel mods for the other kernels installed on host, so they are available after rebooting into them")
+	kernelHook                         = flag.Bool("install-kernel-hook", false, "install hooks on host placing DRBD kernel mods for kernels installed later, without the container")
+	kernelModsDir                      = flag.String("kernel-mods-dir", "/kernel-mods", "dir of DRBD kernel mods catalog")
+	force                              = flag.Bool("force", false, "overwrite the DRBD kernel mods autoloader on host even if it was modified by hand")
+	hostEtcDir                         = flag.String("host-etc-dir", drbd.HostEtcMountDir, "dir where the host /etc is mounted, it must be the host /etc")
+	strictVerMagic                     = flag.Bool("strict-vermagic", false, "refuse DRBD kernel mods whose vermagic differs from host kernel even if they carry modversions")
+	nodeName                           = flag.String("node-name", os.Getenv("NODE_NAME"), "name of the node, labeled with its DRBD state and getting events of install stages through the Kubernetes API if set, $NODE_NAME by default")
+	podName                            = flag.String("pod-name", os.Getenv("POD_NAME"), "name of the installer pod, also getting events of install stages if set, $POD_NAME by default")
+	podNamespace                       = flag.String("pod-namespace", os.Getenv("POD_NAMESPACE"), "namespace of the installer pod, $POD_NAMESPACE by default")
+	kubeAPIURL                         = flag.String("kube-api-url", "", "URL of the Kubernetes API server, found from the in-cluster environment if empty")
+	reportPath                         = flag.String("report-path", drbd.DefaultReportPath, "file the JSON report of the install run is written to, empty disables it")
+	moduleParams                       = drbd.ModuleParams{}
 	BUILDVERSION, BUILDTIME, GOVERSION string
 )
 
+// commandArgCounts are the commands with the number of args each takes
+var commandArgCounts = map[string]int{
+	"install":      0,
+	"uninstall":    0,
+	"status":       0,
+	"stage-kernel": 1,
+}
+
+// eventsFlushTimeout bounds the wait for events queued when exiting
+const eventsFlushTimeout = 10 * time.Second
+
+func init() {
+	flag.Var(moduleParamsFlag(moduleParams), "module-param", "parameter of DRBD kernel mods as <mod>.<param>=<value>, e.g. drbd.minor_count=256, may be repeated")
+}
+
+// moduleParamsFlag collects repeated -module-param flags
+type moduleParamsFlag drbd.ModuleParams
+
+func (f moduleParamsFlag) String() string {
+	var params []string
+	for mod := range f {
+		for _, arg := range drbd.ModuleParams(f).Args(mod) {
+			params = append(params, mod+"."+arg)
+		}
+	}
+	return strings.Join(params, ",")
+}
+
+func (f moduleParamsFlag) Set(value string) error {
+	mod, name, paramValue, err := drbd.ParseModuleParam(value)
+	if err != nil {
+		return err
+	}
+	drbd.ModuleParams(f).Set(mod, name, paramValue)
+	return nil
+}
+
 func printVersion() {
 	log.Info(fmt.Sprintf("GitCommit:%q, BuildDate:%q, GoVersion:%q", BUILDVERSION, BUILDTIME, GOVERSION))
 }
@@ -41,59 +105,261 @@ func setupLogging(enableDebug bool) {
 	log.SetReportCaller(true)
 }
 
-// We presume *.ko file in kernel-mods dir should named as format "alias.ko"
-// "alias" will use for modprobe
+// DRBD kernel mods builds are listed in "kernel-mods/index.json", each with
+// its DRBD version, the kernel it was built against, an optional kernel range
+// it serves, its dir and the *.ko files in load order with SHA-256 digests.
 //
-// The kernel-mods path looks like "kernel-mods/drbd/linux/3.10.0/1160/amd64/"
+// Without index.json, we fall back to the legacy layout and presume *.ko file
+// in kernel-mods dir should named as format "alias.ko", "alias" will use for
+// modprobe. The kernel-mods path looks like "kernel-mods/drbd/linux/3.10.0/1160/amd64/"
 // means this dir contents DRBD kernel mods that fits amd64 linux with kernel
-// version range 3.10.0-1160 to 3.10.0-1160.X
+// version range 3.10.0-1160 to 3.10.0-1160.X under the default same-abi match
+// policy. Other policies are selectable with -match-policy
+//
+// Usage: drbd-installer [flags] [install|uninstall|status] [flags], install by
+// default. "drbd-installer stage-kernel [flags] <release>" is run by the kernel
+// hooks on host, see -install-kernel-hook
+//
+// install exits with one of the codes below, and writes a JSON report of the
+// run with the same code to -report-path, the pod termination message by
+// default:
+//
+//	0 all stages succeeded
+//	1 any other error, e.g. the installer failed to start
+//	2 unknown command or flag
+//	3 no suitable DRBD kernel mods build for host kernel
+//	4 DRBD kernel mods refused or failed to be copied to host
+//	5 depmod failed
+//	6 loading DRBD kernel mods or applying their parameters failed
+//	7 making DRBD kernel mods load on boot failed
+//	8 some stages failed but were skipped with -skip-error
 func main() {
-	flag.Parse()
+	// flags may come before and after the command
+	flag.CommandLine.Parse(os.Args[1:])
+	command := "install"
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 
 	setupLogging(*debug)
 	printVersion()
 
-	DRBDKernelModInstaller, err := drbd.NewDRBDKernelModInstaller()
+	argCount, known := commandArgCounts[command]
+	if !known {
+		log.Errorf("unknown command %q", command)
+		os.Exit(drbd.ExitUsage)
+	}
+	if flag.NArg() != argCount {
+		log.Errorf("command %s takes %d args, got %q", command, argCount, flag.Args())
+		os.Exit(drbd.ExitUsage)
+	}
+
+	DRBDKernelModInstaller, err := drbd.NewDRBDKernelModInstaller(drbd.Config{
+		KernelModsDir:      *kernelModsDir,
+		MatchPolicy:        *matchPolicy,
+		MaxReleaseDistance: *maxReleaseDistance,
+		StrictVerMagic:     *strictVerMagic,
+		DryRun:             *dryRun,
+		SkipError:          *skipError,
+		CheckSymbolCRCs:    *checkSymbolCRCs,
+		AutoloadBackend:    *autoloadBackend,
+		InstalledKernels:   *installedKernels,
+		KernelHook:         *kernelHook,
+		ModuleParams:       moduleParams,
+		Force:              *force,
+		HostEtcDir:         *hostEtcDir,
+	})
 	if err != nil {
-		os.Exit(1)
+		log.WithError(err).Error("Failed to create DRBD kernel mods installer")
+		if command == "install" {
+			writeReport(drbd.NewReport(nil, err))
+		}
+		os.Exit(drbd.ExitError)
 	}
 
-	log.Info("start finding Suitable DRBD kernel mods")
-	if !DRBDKernelModInstaller.HasSuitableDRBDKernelModBuilds() {
-		log.Errorf("No Suitable DRBD kernel mods")
-		return
+	code := drbd.ExitSuccess
+	switch command {
+	case "install":
+		code = install(DRBDKernelModInstaller)
+	case "uninstall":
+		uninstall(DRBDKernelModInstaller)
+	case "status":
+		status(DRBDKernelModInstaller)
+	case "stage-kernel":
+		stageKernel(DRBDKernelModInstaller, flag.Arg(0))
 	}
 
-	log.Info("start copying DRBD kernel mods to host")
-	if err := DRBDKernelModInstaller.CopyKernelModToHost(); err != nil {
-		log.WithError(err).Error("Failed to copy DRBD kernel mods to host")
-		return
+	if DRBDKernelModInstaller.Plan != nil && command != "status" {
+		printPlan(DRBDKernelModInstaller.Plan)
 	}
+	os.Exit(code)
+}
 
-	log.Info("start generating DRBD kernel mods dependencies")
-	if err := DRBDKernelModInstaller.Depmod(); err != nil {
-		log.WithError(err).Error("Failed to generate DRBD kernel mods dependencies")
-		if !*skipError {
-			return
+// install returns the exit code of the install run, or of the last one when
+// reconciling until terminated
+func install(DRBDKernelModInstaller *drbd.DRBDKernelModInstaller) int {
+	var kubeClient *kube.Client
+	if DRBDKernelModInstaller.Plan == nil {
+		kubeClient = newKubeClient()
+	}
+	if kubeClient != nil {
+		recorder := newEventRecorder(kubeClient)
+		DRBDKernelModInstaller.AddStageObserver(recorder.Observe)
+		defer recorder.Stop(eventsFlushTimeout)
+	}
+
+	result := DRBDKernelModInstaller.Install()
+	if DRBDKernelModInstaller.Plan == nil {
+		reconciler := drbd.NewReconciler(DRBDKernelModInstaller, *reconcileInterval)
+		collector := metrics.NewCollector()
+		reconciler.AddObserver(collector.Observe)
+		if kubeClient != nil {
+			reconciler.AddObserver(kube.NewNodeLabeler(kubeClient, *nodeName).Observe)
+		}
+		reconciler.Observe(result)
+
+		if *reconcileInterval > 0 {
+			result = serve(reconciler, collector, true)
+		} else if result.Completed && *block {
+			log.Info("blocking for debug reason")
+			serve(reconciler, collector, false)
 		}
 	}
 
-	log.Info("start installing DRBD kernel mods on host")
-	if err := DRBDKernelModInstaller.Modprobe(); err != nil {
-		log.WithError(err).Error("Failed to install DRBD kernel mods on host")
-		if !*skipError {
+	report := drbd.NewReport(result, nil)
+	if report.ExitCode != drbd.ExitSuccess {
+		log.WithFields(log.Fields{"exitCode": report.ExitCode, "reason": report.Reason, "error": report.Error}).Error("Failed to install DRBD kernel mods")
+	}
+	writeReport(report)
+	return report.ExitCode
+}
+
+// writeReport writes the report to -report-path. The default termination
+// message path only exists in a container, elsewhere the report is skipped
+func writeReport(report *drbd.Report) {
+	if *reportPath == "" {
+		return
+	}
+	if *reportPath == drbd.DefaultReportPath {
+		if _, err := os.Stat(*reportPath); os.IsNotExist(err) {
+			log.Debugf("%s not found, skip writing run report", *reportPath)
 			return
 		}
 	}
+	if err := report.Write(*reportPath); err != nil {
+		log.WithError(err).Warnf("Failed to write run report to %s", *reportPath)
+	}
+}
 
-	log.Info("start ensuring DRBD kernel mods reload when host restarted")
-	if err := DRBDKernelModInstaller.EnsureAutoLoadWhenHostRestarted(); err != nil {
-		log.WithError(err).Error("Failed to ensure DRBD kernel mods auto load when host restarted")
-		return
+// serve keeps running until SIGTERM or SIGINT, reconciling DRBD kernel mods if
+// reconcile is set, and serving HTTP endpoints if an address is given. It
+// returns the last install run
+func serve(reconciler *drbd.Reconciler, collector *metrics.Collector, reconcile bool) *drbd.RunResult {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if *httpAddr != "" {
+		httpServer := server.New(*httpAddr, reconciler, collector)
+		httpServer.Start()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			httpServer.Shutdown(shutdownCtx)
+		}()
 	}
 
-	if *block {
-		log.Info("blocking for debug reason")
-		select {}
+	if reconcile {
+		log.Infof("start reconciling DRBD kernel mods every %s", *reconcileInterval)
+		reconciler.Run(ctx)
+		log.Info("reconciling DRBD kernel mods stopped")
+	} else {
+		<-ctx.Done()
+	}
+	return reconciler.Last().Run
+}
+
+// newKubeClient returns nil if no node name is given or the installer isn't
+// running in a Kubernetes cluster
+func newKubeClient() *kube.Client {
+	if *nodeName == "" {
+		return nil
+	}
+	client, err := kube.NewInClusterClient(*kubeAPIURL)
+	if err != nil {
+		log.WithError(err).Warn("Failed to create Kubernetes client, node won't be labeled with its DRBD state nor get events")
+		return nil
+	}
+	return client
+}
+
+// newEventRecorder posts events against the node, and the pod if its name is
+// given
+func newEventRecorder(client *kube.Client) *kube.EventRecorder {
+	objects := []kube.ObjectReference{kube.NodeReference(*nodeName)}
+	if *podName != "" && *podNamespace != "" {
+		objects = append(objects, kube.PodReference(*podNamespace, *podName, os.Getenv("POD_UID")))
+	}
+	return kube.NewEventRecorder(client, *nodeName, objects...)
+}
+
+func uninstall(DRBDKernelModInstaller *drbd.DRBDKernelModInstaller) {
+	log.Info("start uninstalling DRBD kernel mods from host")
+	var labeler *kube.NodeLabeler
+	if DRBDKernelModInstaller.Plan == nil {
+		if kubeClient := newKubeClient(); kubeClient != nil {
+			labeler = kube.NewNodeLabeler(kubeClient, *nodeName)
+		}
+	}
+	if err := DRBDKernelModInstaller.Uninstall(); err != nil {
+		log.WithError(err).Error("Failed to uninstall DRBD kernel mods from host")
+		if labeler != nil {
+			labeler.Observe(&drbd.ReconcileResult{Time: time.Now(), NotReadyReason: err.Error()})
+		}
+		os.Exit(drbd.ExitError)
+	}
+	if labeler != nil {
+		if err := labeler.Remove(); err != nil {
+			log.WithError(err).Warnf("Failed to remove DRBD labels of node %s", *nodeName)
+		}
+	}
+	log.Info("DRBD kernel mods have being successfully uninstalled from host")
+}
+
+// stageKernel is run by the kernel hooks on host with the release of the
+// kernel just installed
+func stageKernel(DRBDKernelModInstaller *drbd.DRBDKernelModInstaller, release string) {
+	log.Infof("start installing DRBD kernel mods for kernel %s", release)
+	if _, err := DRBDKernelModInstaller.StageKernel(release); err != nil {
+		log.WithError(err).Errorf("Failed to install DRBD kernel mods for kernel %s", release)
+		os.Exit(drbd.ExitError)
+	}
+	log.Infof("DRBD kernel mods have being successfully installed for kernel %s", release)
+}
+
+func status(DRBDKernelModInstaller *drbd.DRBDKernelModInstaller) {
+	if !DRBDKernelModInstaller.HasSuitableDRBDKernelModBuilds() {
+		log.Warn("No Suitable DRBD kernel mods")
+	}
+
+	nodeStatus, err := DRBDKernelModInstaller.Status()
+	if err != nil {
+		log.WithError(err).Error("Failed to get DRBD installation status")
+		os.Exit(drbd.ExitError)
+	}
+	output, err := nodeStatus.Format(*statusFormat)
+	if err != nil {
+		log.WithError(err).Error("Failed to format DRBD installation status")
+		os.Exit(drbd.ExitError)
+	}
+	fmt.Println(strings.TrimSuffix(string(output), "\n"))
+}
+
+func printPlan(plan *drbd.Plan) {
+	output, err := plan.Format(*statusFormat)
+	if err != nil {
+		log.WithError(err).Error("Failed to format dry-run plan")
+		os.Exit(drbd.ExitError)
 	}
+	fmt.Println(strings.TrimSuffix(string(output), "\n"))
 }
@@ -2,6 +2,8 @@ module github.com/hwameistor/drbd-installer
 
 go 1.17
 
-require github.com/sirupsen/logrus v1.8.1
-
-require golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
+require (
+	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -0,0 +1,53 @@
+package arch
+
+import "strings"
+
+// aliases maps the names an arch goes by (`uname -m`, GOARCH, distro and
+// kernel-mods dir conventions) to its canonical name, which is the GOARCH one
+var aliases = map[string]string{
+	"x86_64": "amd64",
+	"amd64":  "amd64",
+	"x64":    "amd64",
+
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv8":   "arm64",
+	// kernel-mods trees built for aarch64 have been shipped as "arm"
+	"arm": "arm64",
+
+	"armv7l": "armv7",
+	"armv7":  "armv7",
+	"armhf":  "armv7",
+
+	"i386": "386",
+	"i486": "386",
+	"i586": "386",
+	"i686": "386",
+	"386":  "386",
+
+	"ppc64le": "ppc64le",
+	"ppc64el": "ppc64le",
+	"ppc64":   "ppc64",
+	"s390x":   "s390x",
+
+	"riscv64":     "riscv64",
+	"loongarch64": "loong64",
+	"loong64":     "loong64",
+	"mips64el":    "mips64le",
+	"mips64le":    "mips64le",
+}
+
+// Canonical returns the canonical name of arch, or arch itself in lower case
+// if it's unknown
+func Canonical(arch string) string {
+	arch = strings.ToLower(strings.TrimSpace(arch))
+	if canonical, exists := aliases[arch]; exists {
+		return canonical
+	}
+	return arch
+}
+
+// Equal reports whether a and b are names of the same arch
+func Equal(a, b string) bool {
+	return Canonical(a) == Canonical(b)
+}
@@ -0,0 +1,329 @@
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hwameistor/drbd-installer/pkg/kernelversion"
+	"github.com/hwameistor/drbd-installer/pkg/kmod"
+)
+
+const (
+	// IndexFileName is the name of the catalog manifest in the kernel mods dir
+	IndexFileName = "index.json"
+	// LegacyDRBDDir is the dir of the legacy layout in the kernel mods dir,
+	// looks like "drbd/<os>/<version>/<release>/<arch>/*.ko"
+	LegacyDRBDDir = "drbd"
+
+	KernelModExt = ".ko"
+
+	// SchemaVersion is the version of the catalog manifest understood here
+	SchemaVersion = 1
+)
+
+// Catalog lists all DRBD kernel mods builds shipped in the container
+type Catalog struct {
+	SchemaVersion int      `json:"schemaVersion"`
+	Builds        []*Build `json:"builds"`
+
+	// Dir is the kernel mods dir the catalog was loaded from
+	Dir string `json:"-"`
+	// Legacy is true if the catalog was built from the legacy layout because
+	// there is no manifest
+	Legacy bool `json:"-"`
+}
+
+// Build is a set of DRBD kernel mods built against one kernel
+type Build struct {
+	DRBDVersion string `json:"drbdVersion"`
+	OS          string `json:"os"`
+	Arch        string `json:"arch"`
+	// Kernel is the release of the kernel the build was made against. Fields
+	// missing from it (e.g. the distro tag of legacy builds) match any host
+	Kernel string `json:"kernel"`
+	// KernelRange optionally narrows the host kernels the build may serve
+	KernelRange *KernelRange `json:"kernelRange,omitempty"`
+	// Dir is the dir of *.ko files, relative to the catalog dir
+	Dir string `json:"dir"`
+	// Modules are listed in load order
+	Modules []*Module `json:"modules"`
+
+	KernelRelease *kernelversion.KernelRelease `json:"-"`
+	// Path is the absolute dir of *.ko files
+	Path string `json:"-"`
+}
+
+// KernelRange is a range of kernel releases, From inclusive and Before exclusive.
+// Either may be empty to leave that side open
+type KernelRange struct {
+	From   string `json:"from,omitempty"`
+	Before string `json:"before,omitempty"`
+}
+
+// Module is a single kernel mod file of a build
+type Module struct {
+	// Name is the name used for modprobe
+	Name string `json:"name"`
+	File string `json:"file"`
+	// SHA256 is the hex encoded digest of the file, required by the manifest
+	SHA256 string `json:"sha256"`
+}
+
+// Load reads the catalog manifest in dir, falling back to the legacy layout
+// if there is none
+func Load(dir string) (*Catalog, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, IndexFileName))
+	if os.IsNotExist(err) {
+		return loadLegacy(dir)
+	} else if err != nil {
+		return nil, err
+	}
+
+	catalog := &Catalog{}
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filepath.Join(dir, IndexFileName), err)
+	}
+	if catalog.SchemaVersion != SchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d of %s, expecting %d", catalog.SchemaVersion, filepath.Join(dir, IndexFileName), SchemaVersion)
+	}
+	catalog.Dir = dir
+	for _, build := range catalog.Builds {
+		if build.KernelRelease, err = kernelversion.Parse(build.Kernel); err != nil {
+			return nil, err
+		}
+		for _, module := range build.Modules {
+			module.SHA256 = strings.ToLower(module.SHA256)
+			if digest, err := hex.DecodeString(module.SHA256); err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("invalid sha256 %q of %s in build %s", module.SHA256, module.File, build)
+			}
+		}
+		if build.KernelRange != nil {
+			if err := build.KernelRange.validate(); err != nil {
+				return nil, fmt.Errorf("invalid kernel range of build %s: %w", build, err)
+			}
+		}
+		build.Path = filepath.Join(dir, build.Dir)
+	}
+	return catalog, nil
+}
+
+// Write saves a catalog of builds to dir, copying their *.ko files into it
+// under the same relative dirs, so it can be loaded by Load
+func Write(dir string, builds []*Build) error {
+	catalog := &Catalog{SchemaVersion: SchemaVersion}
+	for _, build := range builds {
+		copied := *build
+		for _, module := range build.Modules {
+			if err := copyFile(build.ModulePath(module), filepath.Join(dir, build.Dir, module.File)); err != nil {
+				return err
+			}
+		}
+		catalog.Builds = append(catalog.Builds, &copied)
+	}
+
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, IndexFileName), data, 0644)
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		return err
+	}
+	return target.Close()
+}
+
+// loadLegacy builds the catalog from dirs laid out as
+// "<dir>/drbd/<os>/<version>/<release>/<arch>/*.ko", e.g.
+// "/kernel-mods/drbd/linux/3.10.0/1160/amd64/drbd.ko", computing digests on the fly
+func loadLegacy(dir string) (*Catalog, error) {
+	catalog := &Catalog{Dir: dir, Legacy: true}
+
+	osDirs, err := subDirs(filepath.Join(dir, LegacyDRBDDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, osName := range osDirs {
+		versions, err := subDirs(filepath.Join(dir, LegacyDRBDDir, osName))
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			releases, err := subDirs(filepath.Join(dir, LegacyDRBDDir, osName, version))
+			if err != nil {
+				return nil, err
+			}
+			for _, release := range releases {
+				kernel := fmt.Sprintf("%s-%s", version, release)
+				kernelRelease, err := kernelversion.Parse(kernel)
+				if err != nil {
+					continue
+				}
+				arches, err := subDirs(filepath.Join(dir, LegacyDRBDDir, osName, version, release))
+				if err != nil {
+					return nil, err
+				}
+				for _, arch := range arches {
+					build := &Build{
+						OS:            osName,
+						Arch:          arch,
+						Kernel:        kernel,
+						Dir:           filepath.Join(LegacyDRBDDir, osName, version, release, arch),
+						KernelRelease: kernelRelease,
+					}
+					build.Path = filepath.Join(dir, build.Dir)
+					if build.Modules, err = scanModules(build.Path); err != nil {
+						return nil, err
+					}
+					if len(build.Modules) > 0 {
+						// all mods of a build share the DRBD version
+						if info, err := kmod.ReadModInfo(build.ModulePath(build.Modules[0])); err == nil {
+							build.DRBDVersion = info.Version
+						}
+					}
+					catalog.Builds = append(catalog.Builds, build)
+				}
+			}
+		}
+	}
+	return catalog, nil
+}
+
+// scanModules lists *.ko files in dir in name order, which is the load order
+// of the legacy layout
+func scanModules(dir string) ([]*Module, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var modules []*Module
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != KernelModExt {
+			continue
+		}
+		digest, err := FileSHA256(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		modules = append(modules, &Module{
+			Name:   strings.TrimSuffix(file.Name(), KernelModExt),
+			File:   file.Name(),
+			SHA256: digest,
+		})
+	}
+	return modules, nil
+}
+
+func subDirs(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, file := range files {
+		if file.IsDir() {
+			dirs = append(dirs, file.Name())
+		}
+	}
+	return dirs, nil
+}
+
+func (b *Build) String() string {
+	return fmt.Sprintf("%s/%s", b.Kernel, b.Arch)
+}
+
+// Digest returns the hex encoded SHA-256 digest of the names and digests of
+// all module files of the build, identifying its contents
+func (b *Build) Digest() string {
+	hash := sha256.New()
+	for _, module := range b.Modules {
+		fmt.Fprintf(hash, "%s %s\n", module.SHA256, module.File)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ModulePath returns the absolute path of module in the build
+func (b *Build) ModulePath(module *Module) string {
+	return filepath.Join(b.Path, module.File)
+}
+
+// Verify checks the digests of all module files of the build
+func (b *Build) Verify() error {
+	for _, module := range b.Modules {
+		digest, err := FileSHA256(b.ModulePath(module))
+		if err != nil {
+			return err
+		}
+		if digest != module.SHA256 {
+			return fmt.Errorf("checksum mismatch of %s: expected %s, got %s", b.ModulePath(module), module.SHA256, digest)
+		}
+	}
+	return nil
+}
+
+// Contains reports whether kernel is in the range
+func (r *KernelRange) Contains(kernel *kernelversion.KernelRelease) bool {
+	if r.From != "" && kernelversion.Compare(kernel, kernelversion.MustParse(r.From)) < 0 {
+		return false
+	}
+	if r.Before != "" && kernelversion.Compare(kernel, kernelversion.MustParse(r.Before)) >= 0 {
+		return false
+	}
+	return true
+}
+
+func (r *KernelRange) String() string {
+	return fmt.Sprintf("[%s, %s)", r.From, r.Before)
+}
+
+func (r *KernelRange) validate() error {
+	for _, kernel := range []string{r.From, r.Before} {
+		if kernel == "" {
+			continue
+		}
+		if _, err := kernelversion.Parse(kernel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileSHA256 returns the hex encoded SHA-256 digest of the file
+func FileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,77 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const shippedCatalogDir = "../../kernel-mods"
+
+func TestLoadShipped(t *testing.T) {
+	catalog, err := Load(shippedCatalogDir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if catalog.Legacy || len(catalog.Builds) != 2 {
+		t.Fatalf("Load() = %+v, want 2 builds of the manifest", catalog)
+	}
+	for _, build := range catalog.Builds {
+		if err := build.Verify(); err != nil {
+			t.Errorf("Verify() of %s error = %v", build, err)
+		}
+	}
+}
+
+func TestLoadInvalidManifest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		manifest string
+		err      string
+	}{
+		{"unknown schema version", `{"schemaVersion": 2, "builds": []}`, "unsupported schema version 2"},
+		{"no schema version", `{"builds": []}`, "unsupported schema version 0"},
+		{"no sha256", `{"schemaVersion": 1, "builds": [{"os": "linux", "arch": "amd64", "kernel": "3.10.0-1160.el7.x86_64", "dir": "drbd",
+			"modules": [{"name": "drbd", "file": "drbd.ko"}]}]}`, `invalid sha256 "" of drbd.ko`},
+		{"short sha256", `{"schemaVersion": 1, "builds": [{"os": "linux", "arch": "amd64", "kernel": "3.10.0-1160.el7.x86_64", "dir": "drbd",
+			"modules": [{"name": "drbd", "file": "drbd.ko", "sha256": "90cb3d11"}]}]}`, `invalid sha256 "90cb3d11" of drbd.ko`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(dir, IndexFileName), []byte(tc.manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(dir); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Load() error = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	catalog, err := Load(shippedCatalogDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := Write(dir, catalog.Builds[:1]); err != nil {
+		t.Fatal(err)
+	}
+	written, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load() of written catalog error = %v", err)
+	}
+	build := written.Builds[0]
+	if err := build.Verify(); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	path := build.ModulePath(build.Modules[0])
+	if err := ioutil.WriteFile(path, []byte("not a kernel mod"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := build.Verify(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Verify() error = %v, want checksum mismatch", err)
+	}
+}
@@ -0,0 +1,337 @@
+package drbd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hwameistor/drbd-installer/pkg/exechelper"
+)
+
+// Autoload backends, chosen by the init system and distro of the host
+const (
+	AutoloadBackendAuto         = "auto"
+	AutoloadBackendModulesLoadD = "modules-load.d"
+	AutoloadBackendEtcModules   = "etc-modules"
+	AutoloadBackendSysconfig    = "sysconfig"
+	AutoloadBackendSystemdUnit  = "systemd-unit"
+
+	DRBDAutoloaderUnitName = "drbd-modules-load.service"
+	// SysconfigAutoloaderFile is the file of the sysconfig backend in /etc,
+	// it's also where installers before the autoload backends wrote to
+	SysconfigAutoloaderFile = "sysconfig/modules/drbd.modules"
+	SystemctlCMD            = "systemctl"
+
+	etcModulesBlockBegin = "# BEGIN drbd-installer managed block"
+	etcModulesBlockEnd   = "# END drbd-installer managed block"
+
+	// managedHeaderPrefix starts the header of generated content, followed
+	// by the SHA-256 digest of the other lines of the managed content
+	managedHeaderPrefix = "# Managed by drbd-installer, do not edit. sha256:"
+)
+
+// Drift of the autoloader on host from the desired content
+const (
+	AutoloaderMissing  = "missing"
+	AutoloaderCurrent  = "current"
+	AutoloaderOutdated = "outdated"
+	AutoloaderModified = "modified"
+)
+
+// AutoloaderResult is what has been done to the autoloader on host
+type AutoloaderResult struct {
+	Backend string `json:"backend" yaml:"backend"`
+	Path    string `json:"path" yaml:"path"`
+	// Drift is the state of the autoloader found on host, Action is one of
+	// created, updated, unchanged or kept
+	Drift  string `json:"drift" yaml:"drift"`
+	Action string `json:"action" yaml:"action"`
+	// LegacyRemoved is the legacy autoloader removed as another backend is
+	// in use, if any
+	LegacyRemoved string `json:"legacyRemoved,omitempty" yaml:"legacyRemoved,omitempty"`
+}
+
+// AutoloadBackend makes the host load DRBD kernel mods on boot
+type AutoloadBackend interface {
+	Name() string
+	// Path is the file on host managed by the backend
+	Path() string
+	Mode() os.FileMode
+	// Render returns the desired content of Path given its current content,
+	// so that mods are loaded on boot in order. No mod is loaded if mods is
+	// empty
+	Render(current string, mods []string) string
+	// ManagedContent returns the part of content generated by Render, which
+	// carries the managed header
+	ManagedContent(content string) string
+	// Shared is true if Path holds content of others, it's never removed
+	Shared() bool
+	// EnableCommands run on host after Path is written, DisableCommands
+	// before it's removed
+	EnableCommands() []exechelper.ExecParams
+	DisableCommands() []exechelper.ExecParams
+}
+
+// NewAutoloadBackend returns the backend by name, with its file under etcDir,
+// the dir where the host /etc is found
+func NewAutoloadBackend(name, etcDir string) (AutoloadBackend, error) {
+	switch name {
+	case AutoloadBackendModulesLoadD:
+		return &modulesLoadDBackend{path: filepath.Join(etcDir, "modules-load.d", "drbd.conf")}, nil
+	case AutoloadBackendEtcModules:
+		return &etcModulesBackend{path: filepath.Join(etcDir, "modules")}, nil
+	case AutoloadBackendSysconfig:
+		return &sysconfigBackend{path: filepath.Join(etcDir, SysconfigAutoloaderFile)}, nil
+	case AutoloadBackendSystemdUnit:
+		return &systemdUnitBackend{path: filepath.Join(etcDir, "systemd", "system", DRBDAutoloaderUnitName)}, nil
+	}
+	return nil, fmt.Errorf("unknown autoload backend %q", name)
+}
+
+// chooseAutoloadBackend picks the backend for a host by whether it's booted
+// with systemd, whether its root is immutable and its /etc/os-release
+func chooseAutoloadBackend(systemd, immutable bool, osRelease map[string]string) string {
+	switch {
+	case systemd && immutable:
+		return AutoloadBackendSystemdUnit
+	case systemd:
+		return AutoloadBackendModulesLoadD
+	case isDistroLike(osRelease, "debian"):
+		return AutoloadBackendEtcModules
+	}
+	return AutoloadBackendSysconfig
+}
+
+// isImmutableDistro reports whether the distro ships a read-only root where
+// only /etc is writable
+func isImmutableDistro(osRelease map[string]string) bool {
+	switch osRelease["ID"] {
+	case "flatcar", "fedora-coreos", "rhcos", "talos", "bottlerocket":
+		return true
+	}
+	return osRelease["VARIANT_ID"] == "coreos"
+}
+
+func isDistroLike(osRelease map[string]string, distro string) bool {
+	if osRelease["ID"] == distro {
+		return true
+	}
+	for _, like := range strings.Fields(osRelease["ID_LIKE"]) {
+		if like == distro {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOSRelease parses the KEY=value lines of /etc/os-release
+func parseOSRelease(content string) map[string]string {
+	osRelease := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 || strings.HasPrefix(kv[0], "#") {
+			continue
+		}
+		osRelease[kv[0]] = strings.Trim(kv[1], `"'`)
+	}
+	return osRelease
+}
+
+// modulesLoadDBackend lists mods in a modules-load.d(5) file, loaded by
+// systemd-modules-load.service
+type modulesLoadDBackend struct{ path string }
+
+func (b *modulesLoadDBackend) Name() string                             { return AutoloadBackendModulesLoadD }
+func (b *modulesLoadDBackend) Path() string                             { return b.path }
+func (b *modulesLoadDBackend) Mode() os.FileMode                        { return 0644 }
+func (b *modulesLoadDBackend) Shared() bool                             { return false }
+func (b *modulesLoadDBackend) EnableCommands() []exechelper.ExecParams  { return nil }
+func (b *modulesLoadDBackend) DisableCommands() []exechelper.ExecParams { return nil }
+
+func (b *modulesLoadDBackend) ManagedContent(content string) string { return content }
+
+func (b *modulesLoadDBackend) Render(current string, mods []string) string {
+	lines := append([]string{"# Load DRBD kernel mods on boot"}, mods...)
+	return strings.Join(withManagedHeader(lines, 0), "\n") + "\n"
+}
+
+// etcModulesBackend keeps a managed block of mods in the Debian /etc/modules
+type etcModulesBackend struct{ path string }
+
+func (b *etcModulesBackend) Name() string                             { return AutoloadBackendEtcModules }
+func (b *etcModulesBackend) Path() string                             { return b.path }
+func (b *etcModulesBackend) Mode() os.FileMode                        { return 0644 }
+func (b *etcModulesBackend) Shared() bool                             { return true }
+func (b *etcModulesBackend) EnableCommands() []exechelper.ExecParams  { return nil }
+func (b *etcModulesBackend) DisableCommands() []exechelper.ExecParams { return nil }
+
+func (b *etcModulesBackend) Render(current string, mods []string) string {
+	lines, _ := b.split(current)
+	if len(mods) > 0 {
+		lines = append(lines, etcModulesBlockBegin)
+		lines = append(lines, withManagedHeader(mods, 0)...)
+		lines = append(lines, etcModulesBlockEnd)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// ManagedContent returns the lines inside the managed block
+func (b *etcModulesBackend) ManagedContent(content string) string {
+	_, block := b.split(content)
+	return strings.Join(block, "\n")
+}
+
+// split separates the lines out of the managed block from the ones in it
+func (b *etcModulesBackend) split(content string) (others, block []string) {
+	inBlock := false
+	for _, line := range splitLines(content) {
+		switch {
+		case line == etcModulesBlockBegin:
+			inBlock = true
+		case line == etcModulesBlockEnd:
+			inBlock = false
+		case inBlock:
+			block = append(block, line)
+		default:
+			others = append(others, line)
+		}
+	}
+	return others, block
+}
+
+// sysconfigBackend is the executable script in /etc/sysconfig/modules run
+// by legacy RHEL init scripts on boot
+type sysconfigBackend struct{ path string }
+
+func (b *sysconfigBackend) Name() string                             { return AutoloadBackendSysconfig }
+func (b *sysconfigBackend) Path() string                             { return b.path }
+func (b *sysconfigBackend) Mode() os.FileMode                        { return 0755 }
+func (b *sysconfigBackend) Shared() bool                             { return false }
+func (b *sysconfigBackend) EnableCommands() []exechelper.ExecParams  { return nil }
+func (b *sysconfigBackend) DisableCommands() []exechelper.ExecParams { return nil }
+
+func (b *sysconfigBackend) ManagedContent(content string) string { return content }
+
+func (b *sysconfigBackend) Render(current string, mods []string) string {
+	var blocks []string
+	for _, mod := range mods {
+		blocks = append(blocks, fmt.Sprintf(`/sbin/modinfo %s > /dev/null 2>&1
+if [ $? -eq 0 ]; then
+    /sbin/modprobe %s
+fi`, mod, mod))
+	}
+	lines := splitLines("#!/bin/sh\n" + strings.Join(blocks, "\n\n"))
+	// the header goes after the shebang
+	return strings.Join(withManagedHeader(lines, 1), "\n")
+}
+
+// systemdUnitBackend is a oneshot unit loading the mods, for immutable hosts
+// where only /etc is writable and a unit is the most visible way to manage it
+type systemdUnitBackend struct{ path string }
+
+func (b *systemdUnitBackend) Name() string      { return AutoloadBackendSystemdUnit }
+func (b *systemdUnitBackend) Path() string      { return b.path }
+func (b *systemdUnitBackend) Mode() os.FileMode { return 0644 }
+func (b *systemdUnitBackend) Shared() bool      { return false }
+
+func (b *systemdUnitBackend) EnableCommands() []exechelper.ExecParams {
+	return []exechelper.ExecParams{
+		{CmdName: SystemctlCMD, CmdArgs: []string{"daemon-reload"}},
+		{CmdName: SystemctlCMD, CmdArgs: []string{"enable", DRBDAutoloaderUnitName}},
+	}
+}
+
+func (b *systemdUnitBackend) DisableCommands() []exechelper.ExecParams {
+	return []exechelper.ExecParams{
+		{CmdName: SystemctlCMD, CmdArgs: []string{"disable", DRBDAutoloaderUnitName}},
+	}
+}
+
+func (b *systemdUnitBackend) ManagedContent(content string) string { return content }
+
+func (b *systemdUnitBackend) Render(current string, mods []string) string {
+	unit := fmt.Sprintf(`[Unit]
+Description=Load DRBD kernel mods
+DefaultDependencies=no
+After=systemd-modules-load.service
+Before=sysinit.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/sbin/modprobe -a %s
+
+[Install]
+WantedBy=sysinit.target
+`, strings.Join(mods, " "))
+	return strings.Join(withManagedHeader(splitLines(unit), 0), "\n") + "\n"
+}
+
+// withManagedHeader inserts the managed header at index at of lines, with the
+// digest of lines
+func withManagedHeader(lines []string, at int) []string {
+	if at > len(lines) {
+		at = len(lines)
+	}
+	managed := make([]string, 0, len(lines)+1)
+	managed = append(managed, lines[:at]...)
+	managed = append(managed, managedHeaderPrefix+linesDigest(lines))
+	return append(managed, lines[at:]...)
+}
+
+// withoutManagedHeader returns the lines of content but the managed header,
+// along with the digest recorded in the header, empty if there is none
+func withoutManagedHeader(content string) ([]string, string) {
+	var lines []string
+	digest := ""
+	for _, line := range splitLines(content) {
+		if strings.HasPrefix(line, managedHeaderPrefix) {
+			digest = strings.TrimPrefix(line, managedHeaderPrefix)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, digest
+}
+
+func linesDigest(lines []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// autoloaderDrift compares the autoloader on host with the desired content.
+// It's outdated if it was generated by the installer and left untouched, or
+// it's empty, or it only lacks the managed header, as written by previous
+// versions. Otherwise it was modified by hand
+func autoloaderDrift(backend AutoloadBackend, current string, exists bool, desired string) string {
+	switch {
+	case !exists:
+		return AutoloaderMissing
+	case current == desired:
+		return AutoloaderCurrent
+	}
+
+	lines, digest := withoutManagedHeader(backend.ManagedContent(current))
+	switch {
+	case digest != "":
+		if digest == linesDigest(lines) {
+			return AutoloaderOutdated
+		}
+	case strings.TrimSpace(strings.Join(lines, "")) == "":
+		return AutoloaderOutdated
+	default:
+		desiredLines, _ := withoutManagedHeader(backend.ManagedContent(desired))
+		if strings.Join(lines, "\n") == strings.Join(desiredLines, "\n") {
+			return AutoloaderOutdated
+		}
+	}
+	return AutoloaderModified
+}
@@ -0,0 +1,289 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hwameistor/drbd-installer/pkg/exechelper"
+	"github.com/hwameistor/drbd-installer/pkg/exechelper/nsexecutor"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MachineIDFile    = "machine-id"
+	OSReleasePath    = "/etc/os-release"
+	SystemdRunDir    = "/run/systemd/system"
+	OSTreeBootedPath = "/run/ostree-booted"
+	TestCMD          = "test"
+	StatCMD          = "stat"
+)
+
+// validateHostEtcDir makes sure Config.HostEtcDir is the host /etc, so files
+// written there aren't lost in the container. The host machine-id must be
+// found there, or the dir must be the same inode as the host /etc if the host
+// has no machine-id
+func (i *DRBDKernelModInstaller) validateHostEtcDir() error {
+	dir := i.Config.HostEtcDir
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("host /etc is not mounted at %s: %w", dir, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("host /etc is not mounted at %s: not a dir", dir)
+	}
+
+	exec := nsexecutor.New()
+	execRst := exec.RunCommand(exechelper.ExecParams{
+		CmdName: CatCMD,
+		CmdArgs: []string{filepath.Join(HostEtcDir, MachineIDFile)},
+	})
+	if execRst.ExitCode == 0 && strings.TrimSpace(execRst.OutBuf.String()) != "" {
+		hostID := strings.TrimSpace(execRst.OutBuf.String())
+		content, err := ioutil.ReadFile(filepath.Join(dir, MachineIDFile))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if strings.TrimSpace(string(content)) != hostID {
+			return fmt.Errorf("%s is not the host /etc, its machine-id differs from the host one", dir)
+		}
+		return nil
+	}
+
+	log.WithError(execRst.Error).Debugf("No machine-id found on host, compare %s with host /etc by inode", dir)
+	execRst = exec.RunCommand(exechelper.ExecParams{
+		CmdName: StatCMD,
+		CmdArgs: []string{"-L", "-c", "%d:%i", HostEtcDir},
+	})
+	if execRst.ExitCode != 0 {
+		return fmt.Errorf("failed to check %s is the host /etc: %w", dir, &CommandError{Err: execRst.Error, Stderr: execRst.ErrBuf.String()})
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err != nil {
+		return err
+	}
+	if strings.TrimSpace(execRst.OutBuf.String()) != fmt.Sprintf("%d:%d", uint64(stat.Dev), uint64(stat.Ino)) {
+		return fmt.Errorf("%s is not the host /etc", dir)
+	}
+	return nil
+}
+
+// detectAutoloadBackend picks the autoload backend fitting the host init
+// system and distro. The probes only read the host, so they run in dry-run
+// mode as well
+func (i *DRBDKernelModInstaller) detectAutoloadBackend() string {
+	systemd := hostCommandSucceeds(TestCMD, "-d", SystemdRunDir)
+
+	osRelease := map[string]string{}
+	exec := nsexecutor.New()
+	execRst := exec.RunCommand(exechelper.ExecParams{
+		CmdName: CatCMD,
+		CmdArgs: []string{OSReleasePath},
+	})
+	if execRst.ExitCode == 0 {
+		osRelease = parseOSRelease(execRst.OutBuf.String())
+	} else {
+		log.WithError(execRst.Error).Warnf("Failed to read %s of host", OSReleasePath)
+	}
+	immutable := isImmutableDistro(osRelease) || hostCommandSucceeds(TestCMD, "-e", OSTreeBootedPath)
+
+	backend := chooseAutoloadBackend(systemd, immutable, osRelease)
+	log.WithFields(log.Fields{
+		"systemd":   systemd,
+		"immutable": immutable,
+		"distro":    osRelease["ID"],
+		"backend":   backend,
+	}).Info("Detected DRBD kernel mods autoload backend")
+	return backend
+}
+
+func hostCommandSucceeds(name string, args ...string) bool {
+	exec := nsexecutor.New()
+	return exec.RunCommand(exechelper.ExecParams{CmdName: name, CmdArgs: args}).ExitCode == 0
+}
+
+// EnsureAutoLoadWhenHostRestarted makes the host load the installed DRBD
+// kernel mods on boot through the autoload backend. An autoloader drifted
+// from the desired content is rewritten, unless it was modified by hand and
+// Config.Force is not set
+func (i *DRBDKernelModInstaller) EnsureAutoLoadWhenHostRestarted() (AutoloaderResult, error) {
+	path := i.Autoloader.Path()
+	result := AutoloaderResult{Backend: i.Autoloader.Name(), Path: path, Action: FileUnchanged}
+
+	legacyRemoved, err := i.removeLegacyAutoloader(StageAutoload)
+	if err != nil {
+		return result, err
+	}
+	if legacyRemoved {
+		result.LegacyRemoved = i.legacyAutoloaderPath()
+	}
+
+	mods, err := i.installedModNames()
+	if err != nil {
+		return result, err
+	}
+	current, exists, err := readFileIfExists(path)
+	if err != nil {
+		return result, err
+	}
+	desired := i.Autoloader.Render(current, mods)
+	result.Drift = autoloaderDrift(i.Autoloader, current, exists, desired)
+
+	switch result.Drift {
+	case AutoloaderCurrent:
+		return result, nil
+	case AutoloaderMissing:
+		result.Action = FileCreated
+	case AutoloaderOutdated:
+		result.Action = FileUpdated
+	case AutoloaderModified:
+		result.Action = FileUpdated
+		if !i.Config.Force {
+			result.Action = FileKept
+			log.Warnf("%s has been modified by hand, keep it. Use force to overwrite it", path)
+		}
+	}
+
+	if i.Plan != nil {
+		i.planAutoloader(result, current, desired)
+		return result, nil
+	}
+	if result.Action == FileKept {
+		return result, nil
+	}
+
+	if err := i.trackHostFile(path); err != nil {
+		return result, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return result, err
+	}
+	if err := writeContentAtomic(path, []byte(desired), i.Autoloader.Mode()); err != nil {
+		return result, err
+	}
+	log.WithFields(log.Fields{"file": path, "drift": result.Drift}).Infof("DRBD kernel mods autoloader %s", result.Action)
+	for _, cmd := range i.Autoloader.EnableCommands() {
+		if err := i.runHostCommand(StageAutoload, cmd); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// planAutoloader records the autoloader EnsureAutoLoadWhenHostRestarted would
+// write along with its content diff
+func (i *DRBDKernelModInstaller) planAutoloader(result AutoloaderResult, current, desired string) {
+	action := PlanAction{
+		Stage: StageAutoload,
+		Kind:  PlanCreateFile,
+		Path:  result.Path,
+		Size:  int64(len(desired)),
+		Mode:  fmt.Sprintf("%04o", i.Autoloader.Mode()),
+		Diff:  diffLines(current, desired),
+		Note:  fmt.Sprintf("autoloader is %s", result.Drift),
+	}
+	switch result.Action {
+	case FileUpdated:
+		action.Kind = PlanOverwriteFile
+	case FileKept:
+		action.Kind = PlanUnchangedFile
+		action.Note = "autoloader modified by hand is kept, use force to overwrite it"
+	}
+	i.Plan.add(action)
+
+	if action.Kind != PlanUnchangedFile {
+		for _, cmd := range i.Autoloader.EnableCommands() {
+			i.runHostCommand(StageAutoload, cmd)
+		}
+	}
+}
+
+// legacyAutoloaderPath is where installers before the autoload backends
+// wrote the autoloader, the file of the sysconfig backend
+func (i *DRBDKernelModInstaller) legacyAutoloaderPath() string {
+	return filepath.Join(i.Config.HostEtcDir, SysconfigAutoloaderFile)
+}
+
+// removeLegacyAutoloader removes the legacy autoloader left on host when
+// another backend is in use, it returns true if there was one
+func (i *DRBDKernelModInstaller) removeLegacyAutoloader(stage string) (bool, error) {
+	if i.Autoloader.Name() == AutoloadBackendSysconfig {
+		return false, nil
+	}
+	path := i.legacyAutoloaderPath()
+	if exists, err := isFileExists(path); err != nil || !exists {
+		return false, err
+	}
+
+	if i.Plan != nil {
+		i.Plan.add(PlanAction{
+			Stage: stage,
+			Kind:  PlanRemoveFile,
+			Path:  path,
+			Note:  fmt.Sprintf("legacy autoloader replaced by %s", i.Autoloader.Name()),
+		})
+		return true, nil
+	}
+	if err := i.trackHostFile(path); err != nil {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	log.WithField("file", path).Info("Legacy DRBD kernel mods autoloader removed")
+	return true, nil
+}
+
+// removeAutoloader disables and removes the autoloader, or only drops the
+// managed block of a shared file. The legacy autoloader is removed as well
+func (i *DRBDKernelModInstaller) removeAutoloader() error {
+	if _, err := i.removeLegacyAutoloader(StageUninstall); err != nil {
+		return err
+	}
+
+	path := i.Autoloader.Path()
+	current, exists, err := readFileIfExists(path)
+	if err != nil || !exists {
+		return err
+	}
+
+	if i.Autoloader.Shared() {
+		desired := i.Autoloader.Render(current, nil)
+		if desired == current {
+			return nil
+		}
+		if i.Plan != nil {
+			i.Plan.add(PlanAction{
+				Stage: StageUninstall,
+				Kind:  PlanOverwriteFile,
+				Path:  path,
+				Size:  int64(len(desired)),
+				Mode:  fmt.Sprintf("%04o", i.Autoloader.Mode()),
+				Diff:  diffLines(current, desired),
+			})
+			return nil
+		}
+		return writeContentAtomic(path, []byte(desired), i.Autoloader.Mode())
+	}
+
+	for _, cmd := range i.Autoloader.DisableCommands() {
+		if err := i.runHostCommand(StageUninstall, cmd); err != nil {
+			return err
+		}
+	}
+	return i.removeHostFile(path)
+}
+
+func readFileIfExists(path string) (string, bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return string(content), true, nil
+}
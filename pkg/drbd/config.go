@@ -0,0 +1,53 @@
+package drbd
+
+const (
+	HostEtcDir = "/etc"
+	// HostEtcMountDir is where the host /etc is expected to be mounted in the
+	// container by default
+	HostEtcMountDir = "/host/etc"
+)
+
+// Config holds the options DRBDKernelModInstaller is created with
+type Config struct {
+	// KernelModsDir is the root dir of DRBD kernel mods shipped in the container
+	KernelModsDir string
+	// MatchPolicy is the name of the policy used to find a build for the host
+	// kernel, see MatchPolicy* constants
+	MatchPolicy string
+	// MaxReleaseDistance limits how far a build's ABI number may be from the
+	// host's under the nearest-lower policy, 0 means unlimited
+	MaxReleaseDistance int
+	// StrictVerMagic refuses mods whose vermagic kernel release differs from
+	// the host's even if they carry modversions
+	StrictVerMagic bool
+	// DryRun makes the installer only record what it would do to the host in
+	// a Plan, without any side effect
+	DryRun bool
+	// SkipError keeps the pipeline going when Depmod, Modprobe or
+	// EnsureAutoLoadWhenHostRestarted fails, without rolling back
+	SkipError bool
+	// CheckSymbolCRCs checks symbol CRCs of the mods against the host kernel
+	// before installing
+	CheckSymbolCRCs bool
+	// StateDir is the host dir keeping installer state such as backups
+	StateDir string
+	// AutoloadBackend is the name of the backend loading DRBD kernel mods on
+	// boot, see AutoloadBackend* constants. It's detected from the host if
+	// empty or auto
+	AutoloadBackend string
+	// InstalledKernels stages the mods for every kernel installed on host
+	// besides the running one
+	InstalledKernels bool
+	// KernelHook installs hooks on host placing the mods for kernels
+	// installed later, see InstallKernelHook
+	KernelHook bool
+	// ModuleParams are the parameters of DRBD kernel mods, written to the
+	// modprobe.d file on host and passed when loading the mods
+	ModuleParams ModuleParams
+	// Force overwrites the autoloader and modprobe.d file even if they were
+	// modified by hand. Files not written by the installer are never removed
+	Force bool
+	// HostEtcDir is where the host /etc is mounted in the container,
+	// HostEtcMountDir by default. It's checked to be the host /etc
+	HostEtcDir string
+}
@@ -0,0 +1,74 @@
+package drbd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Results of writing a file on host
+const (
+	FileCreated   = "created"
+	FileUpdated   = "updated"
+	FileUnchanged = "unchanged"
+	FileRemoved   = "removed"
+	// FileKept is a file modified by hand left as it is
+	FileKept = "kept"
+)
+
+// FileResult is what has been done to a file on host
+type FileResult struct {
+	Path   string `json:"path" yaml:"path"`
+	Action string `json:"action" yaml:"action"`
+	SHA256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+}
+
+// writeFileAtomic writes the content of reader to a temp file in the dir of
+// path, syncs it, sets perm and renames it into place, so path never holds a
+// partially written file even if we crash halfway
+func writeFileAtomic(path string, reader io.Reader, perm os.FileMode) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = io.Copy(tmp, reader); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeContentAtomic is writeFileAtomic for in memory content
+func writeContentAtomic(path string, content []byte, perm os.FileMode) error {
+	return writeFileAtomic(path, bytes.NewReader(content), perm)
+}
+
+// syncDir persists renames in dir
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,144 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hwameistor/drbd-installer/pkg/kmod"
+	log "github.com/sirupsen/logrus"
+)
+
+// DepmodConfFile is the depmod.d file making the DRBD kernel mods installed
+// by us take precedence over the in-tree ones, relative to the host /etc
+const DepmodConfFile = "depmod.d/drbd.conf"
+
+func (i *DRBDKernelModInstaller) depmodConfPath() string {
+	return filepath.Join(i.Config.HostEtcDir, DepmodConfFile)
+}
+
+// EnsureDepmodOverride writes the depmod.d file overriding the DRBD kernel
+// mods of any kernel with the ones in DRBDModsSubDir. Without it depmod
+// prefers the in-tree drbd 8.4 shipped by distros like Ubuntu, as the kernel
+// dir is searched first. Blacklisting doesn't help here, as it's by name and
+// would hit our drbd as well
+func (i *DRBDKernelModInstaller) EnsureDepmodOverride() (FileResult, error) {
+	mods, err := i.installedModNames()
+	if err != nil {
+		return FileResult{}, err
+	}
+	for _, mod := range mods {
+		if path, err := i.resolvedModPath(mod); err != nil {
+			return FileResult{}, err
+		} else if path != "" && !isInstalledModPath(path) {
+			log.WithField("path", path).Warnf("foreign %s kernel mod found on host, overriding it", mod)
+		}
+	}
+	return i.ensureManagedHostFile(StageDepmodOverride, i.depmodConfPath(), renderDepmodConf(mods), ManagedFileMode)
+}
+
+func renderDepmodConf(mods []string) string {
+	sorted := append([]string{}, mods...)
+	sort.Strings(sorted)
+
+	lines := []string{"# Prefer DRBD kernel mods installed by drbd-installer"}
+	for _, mod := range sorted {
+		lines = append(lines, fmt.Sprintf("override %s * %s", mod, DRBDModsSubDir))
+	}
+	return strings.Join(withManagedHeader(lines, 0), "\n") + "\n"
+}
+
+// resolvedModPath returns the path of the mod in modules.dep of the host
+// kernel, which is the one modprobe loads, relative to the kernel mods dir
+func (i *DRBDKernelModInstaller) resolvedModPath(name string) (string, error) {
+	file, err := os.Open(fmt.Sprintf(ModulesDepPathTemplate, i.Kernel.Original))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	modules, err := kmod.ParseModulesDep(file)
+	if err != nil {
+		return "", err
+	}
+	return modules[name], nil
+}
+
+// isInstalledModPath tells whether a modules.dep path, relative or absolute
+// as written by old depmod, is in DRBDModsSubDir
+func isInstalledModPath(path string) bool {
+	return strings.HasPrefix(path, DRBDModsSubDir+"/") || strings.Contains(path, "/"+DRBDModsSubDir+"/")
+}
+
+// checkDRBDResolution makes sure modprobe would load the mods of the chosen
+// build installed by us and not in-tree ones. A build may ship only the
+// transports, relying on the drbd of the host, which isn't checked then. It
+// relies on modules.dep regenerated by Depmod, so it's skipped in dry-run mode
+func (i *DRBDKernelModInstaller) checkDRBDResolution() error {
+	if i.Plan != nil {
+		return nil
+	}
+	mods, err := i.installedModNames()
+	if err != nil {
+		return err
+	}
+	for _, mod := range mods {
+		path, err := i.resolvedModPath(mod)
+		if err != nil {
+			return err
+		}
+		if path != "" && !isInstalledModPath(path) {
+			return fmt.Errorf("modprobe resolves %s to foreign %s instead of %s, check %s", mod, path, DRBDModsSubDir, i.depmodConfPath())
+		}
+	}
+	return nil
+}
+
+// verifyLoadedSrcVersions checks the srcversion of every loaded mod matches
+// the file we shipped, so a foreign mod loaded instead is caught
+func (i *DRBDKernelModInstaller) verifyLoadedSrcVersions() error {
+	if i.Plan != nil {
+		return nil
+	}
+	mods, err := i.modsToLoad()
+	if err != nil {
+		return err
+	}
+	for _, mod := range mods {
+		if mod.SrcVersion == "" {
+			continue
+		}
+		loaded, err := readSysModuleAttr(mod.Name, "srcversion")
+		if err != nil {
+			return fmt.Errorf("failed to read srcversion of loaded %s: %w", mod.Name, err)
+		}
+		if loaded != mod.SrcVersion {
+			return fmt.Errorf("loaded %s has srcversion %s, expecting %s of %s", mod.Name, loaded, mod.SrcVersion, mod.Path)
+		}
+	}
+	return nil
+}
+
+// buildSrcVersion returns the srcversion of the mod in the chosen build, empty
+// if it's unknown
+func (i *DRBDKernelModInstaller) buildSrcVersion(name string) string {
+	if i.Build == nil {
+		return ""
+	}
+	for _, module := range i.Build.Modules {
+		if module.Name != name {
+			continue
+		}
+		if info, err := kmod.ReadModInfo(i.Build.ModulePath(module)); err == nil {
+			return info.SrcVersion
+		}
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Install runs the install pipeline: finds a build, copies it to host,
+// generates dependencies, loads the mods and makes them load on boot.
+// Host changes are made in a transaction and reverted if a stage after
+// CopyKernelModToHost fails, unless Config.SkipError is set
+func (i *DRBDKernelModInstaller) Install() *RunResult {
+	result := &RunResult{
+		StartTime: time.Now(),
+		Kernel:    i.Kernel.Original,
+	}
+	i.UpgradePending = false
+	defer func() {
+		result.EndTime = time.Now()
+		result.UpgradePending = i.UpgradePending
+	}()
+
+	if !i.runStage(result, StageFindBuild, "finding Suitable DRBD kernel mods", func() error {
+		if !i.HasSuitableDRBDKernelModBuilds() {
+			return ErrNoSuitableBuild
+		}
+		return nil
+	}) {
+		return result
+	}
+	result.Build = i.Build.String()
+	result.DRBDVersion = i.Build.DRBDVersion
+	result.BuildDigest = i.Build.Digest()
+
+	if i.Config.CheckSymbolCRCs {
+		if !i.runStage(result, StageCheckSymbolCRCs, "checking DRBD kernel mods symbol CRCs against host kernel", i.CheckSymbolCRCs) {
+			return result
+		}
+	}
+
+	if !i.runStage(result, StageCheckDepends, "checking DRBD kernel mods dependencies on host kernel", i.CheckExternalDepends) {
+		return result
+	}
+
+	if i.Plan == nil {
+		if err := i.beginTransaction(); err != nil {
+			log.WithError(err).Warn("Failed to begin transaction, host changes won't be rolled back on failure")
+		}
+	}
+
+	if !i.runStage(result, StageCopy, "copying DRBD kernel mods to host", func() (err error) {
+		result.Files, err = i.CopyKernelModToHost()
+		return err
+	}) {
+		i.rollbackRun(result)
+		return result
+	}
+
+	for _, stage := range []struct {
+		name, description string
+		run               func() error
+	}{
+		{StageDepmodOverride, "ensuring DRBD kernel mods take precedence over in-tree ones", func() error {
+			depmodConf, err := i.EnsureDepmodOverride()
+			result.DepmodConf = &depmodConf
+			return err
+		}},
+		{StageDepmod, "generating DRBD kernel mods dependencies", i.Depmod},
+		{StageModprobeConf, "ensuring DRBD kernel mods parameters on host", func() error {
+			modprobeConf, err := i.EnsureModprobeConf()
+			result.ModprobeConf = &modprobeConf
+			return err
+		}},
+		{StageModprobe, "installing DRBD kernel mods on host", i.Modprobe},
+		{StageApplyModuleParams, "applying DRBD kernel mods parameters to loaded mods", func() (err error) {
+			result.ParamChanges, err = i.ApplyModuleParams()
+			return err
+		}},
+		{StageInstalledKernels, "staging DRBD kernel mods for installed kernels", func() (err error) {
+			result.InstalledKernels, err = i.StageInstalledKernels()
+			return err
+		}},
+		{StageKernelHook, "installing DRBD kernel mods hooks for kernels installed later", func() (err error) {
+			result.KernelHooks, err = i.InstallKernelHook()
+			return err
+		}},
+		{StageAutoload, "ensuring DRBD kernel mods reload when host restarted", func() error {
+			autoloader, err := i.EnsureAutoLoadWhenHostRestarted()
+			result.Autoloader = &autoloader
+			return err
+		}},
+	} {
+		if (stage.name == StageInstalledKernels && !i.Config.InstalledKernels) || (stage.name == StageKernelHook && !i.Config.KernelHook) {
+			continue
+		}
+		if !i.runStage(result, stage.name, stage.description, stage.run) && !i.Config.SkipError {
+			i.rollbackRun(result)
+			return result
+		}
+	}
+
+	i.commitTransaction()
+	result.Completed = true
+	result.Success = result.FailedStage() == nil
+	return result
+}
+
+// runStage runs a stage of the pipeline and records its result, it returns
+// false if the stage failed
+func (i *DRBDKernelModInstaller) runStage(result *RunResult, stage, description string, run func() error) bool {
+	log.Infof("start %s", description)
+	i.notifyStage(StageEvent{Stage: stage, Description: description, Phase: StageStarted})
+	start := time.Now()
+	err := run()
+
+	stageResult := StageResult{
+		Stage:    stage,
+		Success:  err == nil,
+		Duration: time.Since(start),
+		err:      err,
+	}
+	event := StageEvent{Stage: stage, Description: description, Phase: StageSucceeded, Duration: stageResult.Duration}
+	if err != nil {
+		stageResult.Error = err.Error()
+		stageResult.Stderr = commandStderr(err)
+		event.Phase, event.Error = StageFailed, stageResult.Error
+		log.WithError(err).Errorf("Failed %s", description)
+	}
+	result.Stages = append(result.Stages, stageResult)
+	i.notifyStage(event)
+	return err == nil
+}
+
+// AddStageObserver registers a func called when every stage of the install
+// pipeline starts and ends, e.g. to post events. Stages of dry-run are not
+// observed
+func (i *DRBDKernelModInstaller) AddStageObserver(observer func(StageEvent)) {
+	i.stageObservers = append(i.stageObservers, observer)
+}
+
+func (i *DRBDKernelModInstaller) notifyStage(event StageEvent) {
+	if i.Plan != nil {
+		return
+	}
+	for _, observer := range i.stageObservers {
+		observer(event)
+	}
+}
+
+func (i *DRBDKernelModInstaller) rollbackRun(result *RunResult) {
+	if i.tx == nil {
+		return
+	}
+
+	log.Info("start rolling back DRBD kernel mods changes on host")
+	result.Rollback = i.rollback()
+	logCtx := log.WithFields(log.Fields{
+		"restored": result.Rollback.Restored,
+		"removed":  result.Rollback.Removed,
+		"reloaded": result.Rollback.Reloaded,
+	})
+	if result.Rollback.Success {
+		logCtx.Info("DRBD kernel mods changes have being successfully rolled back")
+	} else {
+		logCtx.WithField("error", result.Rollback.Error).Error("Failed to roll back DRBD kernel mods changes")
+	}
+}
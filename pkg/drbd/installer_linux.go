@@ -1,197 +1,534 @@
+//go:build linux
 // +build linux
 
 package drbd
 
 import (
+	"bytes"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
-	"syscall"
 
+	"github.com/hwameistor/drbd-installer/pkg/arch"
+	"github.com/hwameistor/drbd-installer/pkg/catalog"
 	"github.com/hwameistor/drbd-installer/pkg/exechelper"
 	"github.com/hwameistor/drbd-installer/pkg/exechelper/nsexecutor"
+	"github.com/hwameistor/drbd-installer/pkg/kernelversion"
+	"github.com/hwameistor/drbd-installer/pkg/kmod"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	DRBDAutoloaderFile = "/etc/sysconfig/modules/drbd.modules"
-	DRBDAutoloader     = `#!/bin/sh
-/sbin/modinfo drbd > /dev/null 2>&1
-if [ $? -eq 0 ]; then
-    /sbin/modprobe drbd
-fi
-
-/sbin/modinfo drbd_transport_tcp > /dev/null 2>&1
-if [ $? -eq 0 ]; then
-    /sbin/modprobe drbd_transport_tcp
-fi`
-	LibModulesPathTemplate      = "/lib/modules/%s/extra/drbd90"
-	DRBDPathInContainerTemplate = "/kernel-mods/drbd/%s/%s/%s/%s"
-	DepmodCMD                   = "depmod"
-	ModprobeCMD                 = "modprobe"
+	// DRBDModsSubDir is the dir of DRBD kernel mods in the kernel mods dir
+	DRBDModsSubDir               = "extra/drbd90"
+	LibModulesPathTemplate       = "/lib/modules/%s/" + DRBDModsSubDir
+	DRBDKernelModsDirInContainer = "/kernel-mods"
+	StateDir                     = "/var/lib/drbd-installer"
+	DepmodCMD                    = "depmod"
+	ModprobeCMD                  = "modprobe"
+	CatCMD                       = "cat"
+	ZcatCMD                      = "zcat"
+	ModinfoCMD                   = "modinfo"
+	KallsymsPath                 = "/proc/kallsyms"
+
+	KernelModFileMode = 0644
 )
 
+// hostSymversSources are tried in order to get the CRCs of symbols exported
+// by the host kernel, through the host mount namespace
+var hostSymversSources = []struct {
+	cmd          string
+	pathTemplate string
+}{
+	{ZcatCMD, "/boot/symvers-%s.gz"},
+	{ZcatCMD, "/lib/modules/%s/symvers.gz"},
+	{CatCMD, "/lib/modules/%s/build/Module.symvers"},
+	{CatCMD, "/usr/src/kernels/%s/Module.symvers"},
+	{CatCMD, "/usr/src/linux-headers-%s/Module.symvers"},
+}
+
 type DRBDKernelModInstaller struct {
 	OS,
 	Arch,
-	KernelVersion,
-	KernelRelease,
-	KernelVersionReleaseOriginString,
+	Machine,
 	KernelModToHostPath,
 	KernelModSourcePath string
+	Kernel *kernelversion.KernelRelease
+	Build  *catalog.Build
+	// Catalog is the catalog the build was chosen from
+	Catalog *catalog.Catalog
+	Policy  MatchPolicy
+	Config  Config
+	// Autoloader makes the host load DRBD kernel mods on boot
+	Autoloader AutoloadBackend
+
+	// LoadedDRBDVersion is the version of drbd loaded before installing
+	LoadedDRBDVersion string
+	// UpgradePending is true if the loaded drbd differs from Build but is in
+	// use, so the new one will only be loaded after next reboot
+	UpgradePending bool
+	// Plan collects what would be done to the host in dry-run mode, it's nil
+	// otherwise
+	Plan *Plan
+
+	tx             *transaction
+	stageObservers []func(StageEvent)
+	// lastSelection sums up the last build selection, so a reconcile pass
+	// choosing the same way doesn't log it again
+	lastSelection string
 }
 
-func NewDRBDKernelModInstaller() (*DRBDKernelModInstaller, error) {
+func NewDRBDKernelModInstaller(config Config) (*DRBDKernelModInstaller, error) {
+	if config.KernelModsDir == "" {
+		config.KernelModsDir = DRBDKernelModsDirInContainer
+	}
+	if config.StateDir == "" {
+		config.StateDir = StateDir
+	}
+	if config.HostEtcDir == "" {
+		config.HostEtcDir = HostEtcMountDir
+	}
+	policy, err := NewMatchPolicy(config.MatchPolicy, config.MaxReleaseDistance)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.ModuleParams.Validate(); err != nil {
+		return nil, err
+	}
+
 	installer := &DRBDKernelModInstaller{
-		OS:   runtime.GOOS,
-		Arch: runtime.GOARCH,
+		OS:     runtime.GOOS,
+		Policy: policy,
+		Config: config,
+	}
+	if config.DryRun {
+		installer.Plan = &Plan{}
 	}
 
 	if err := installer.parseKernelVersionAndRelease(); err != nil {
 		return nil, err
 	}
 
-	installer.KernelModToHostPath = strings.ToLower(fmt.Sprintf(LibModulesPathTemplate, installer.KernelVersionReleaseOriginString))
-	installer.KernelModSourcePath = strings.ToLower(fmt.Sprintf(DRBDPathInContainerTemplate, installer.OS, installer.KernelVersion, installer.KernelRelease, installer.Arch))
+	installer.KernelModToHostPath = strings.ToLower(fmt.Sprintf(LibModulesPathTemplate, installer.Kernel.Original))
+
+	if err := installer.validateHostEtcDir(); err != nil {
+		return nil, err
+	}
+
+	backend := config.AutoloadBackend
+	if backend == "" || backend == AutoloadBackendAuto {
+		backend = installer.detectAutoloadBackend()
+	}
+	if installer.Autoloader, err = NewAutoloadBackend(backend, config.HostEtcDir); err != nil {
+		return nil, err
+	}
 
 	log.Infof("host OS: %s", installer.OS)
 	log.Infof("host CPU arch: %s", installer.Arch)
-	log.Infof("host kernel: %s", installer.KernelVersionReleaseOriginString)
-	log.Infof("host kernel version: %s", installer.KernelVersion)
-	log.Infof("host kernel release: %s", installer.KernelRelease)
+	log.Infof("host machine: %s", installer.Machine)
+	log.Infof("host kernel: %s", installer.Kernel.Original)
+	log.Infof("host kernel version: %s", installer.Kernel.Version())
+	log.Infof("host kernel release: %s", installer.Kernel.Release)
+	log.Infof("host kernel distro tag: %s, flavour: %s", installer.Kernel.DistroTag, installer.Kernel.Flavour)
 	log.Infof("host kernel mods Host Path: %s", installer.KernelModToHostPath)
+	log.Infof("kernel mods match policy: %s", installer.Policy.Name())
+	log.Infof("kernel mods autoload backend: %s (%s)", installer.Autoloader.Name(), installer.Autoloader.Path())
+	if installer.Plan != nil {
+		log.Info("dry-run mode, nothing will be changed on host")
+	}
 
 	return installer, nil
 }
 
 func (i *DRBDKernelModInstaller) HasSuitableDRBDKernelModBuilds() bool {
-	if _, err := os.Stat(i.KernelModSourcePath); os.IsNotExist(err) {
+	modsCatalog, err := catalog.Load(i.Config.KernelModsDir)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to load DRBD kernel mods catalog in %s", i.Config.KernelModsDir)
 		return false
-	} else if err != nil {
+	}
+	build, rejections := SelectBuild(i.Policy, i.Kernel, i.OS, i.Arch, modsCatalog.Builds)
+
+	// the selection is logged at debug level only, unless it changed
+	selection := []string{""}
+	if build != nil {
+		selection[0] = build.String()
+	}
+	for _, rejection := range rejections {
+		selection = append(selection, rejection.Build.String()+": "+rejection.Reason)
+	}
+	level := log.InfoLevel
+	if summary := strings.Join(selection, "\n"); summary == i.lastSelection {
+		level = log.DebugLevel
+	} else {
+		i.lastSelection = summary
+	}
+
+	if modsCatalog.Legacy {
+		log.StandardLogger().Logf(level, "no %s found in %s, using legacy layout", catalog.IndexFileName, i.Config.KernelModsDir)
+	}
+	for _, rejection := range rejections {
+		log.WithFields(log.Fields{"build": rejection.Build.String(), "reason": rejection.Reason}).Log(level, "Rejected DRBD kernel mods build")
+	}
+	if build == nil {
 		return false
 	}
 
+	log.WithFields(log.Fields{"build": build.String(), "drbdVersion": build.DRBDVersion, "path": build.Path}).Log(level, "Chose DRBD kernel mods build")
+	i.Catalog = modsCatalog
+	i.Build = build
+	i.KernelModSourcePath = build.Path
 	return true
 }
 
-func (i *DRBDKernelModInstaller) CopyKernelModToHost() error {
-	if err := os.MkdirAll(i.KernelModToHostPath, os.ModePerm); err != nil {
-		return err
+// CopyKernelModToHost installs the mods of the chosen build into
+// KernelModToHostPath. Each file is written atomically and skipped if its
+// digest is unchanged, the result of every file is returned
+func (i *DRBDKernelModInstaller) CopyKernelModToHost() ([]FileResult, error) {
+	return i.copyBuild(i.Build, i.Kernel.Original, i.KernelModToHostPath)
+}
+
+// copyBuild verifies and validates the mods of build against kernel and
+// installs them into dir
+func (i *DRBDKernelModInstaller) copyBuild(build *catalog.Build, kernel, dir string) ([]FileResult, error) {
+	if err := build.Verify(); err != nil {
+		return nil, err
+	}
+	if err := i.validateBuild(build, kernel); err != nil {
+		return nil, err
+	}
+
+	if i.Plan != nil {
+		return nil, i.planCopyBuild(build, dir)
 	}
 
-	files, err := ioutil.ReadDir(i.KernelModSourcePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	var results []FileResult
+	for _, module := range build.Modules {
+		src := build.ModulePath(module)
+		dst := fmt.Sprintf("%s/%s", dir, module.File)
+
+		result, err := i.copyKernelModFile(src, dst, module.SHA256)
+		if err != nil {
+			return results, err
+		}
+		log.WithFields(log.Fields{"file": dst, "sha256": result.SHA256}).Infof("DRBD kernel mod file %s", result.Action)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (i *DRBDKernelModInstaller) copyKernelModFile(src, dst, digest string) (FileResult, error) {
+	result := FileResult{Path: dst, Action: FileCreated, SHA256: digest}
+
+	exists, err := isFileExists(dst)
 	if err != nil {
-		return err
+		return result, err
+	}
+	if exists {
+		current, err := catalog.FileSHA256(dst)
+		if err != nil {
+			return result, err
+		}
+		if current == digest {
+			result.Action = FileUnchanged
+			return result, nil
+		}
+		result.Action = FileUpdated
+	}
+	if err := i.trackHostFile(dst); err != nil {
+		return result, err
 	}
 
-	for _, file := range files {
-		src := fmt.Sprintf("%s/%s", i.KernelModSourcePath, file.Name())
-		dst := fmt.Sprintf("%s/%s", i.KernelModToHostPath, file.Name())
+	source, err := os.Open(src)
+	if err != nil {
+		return result, err
+	}
+	defer source.Close()
 
-		source, err := os.Open(src)
+	return result, writeFileAtomic(dst, source, KernelModFileMode)
+}
+
+// planCopyBuild records the module files copyBuild would create or overwrite
+func (i *DRBDKernelModInstaller) planCopyBuild(build *catalog.Build, dir string) error {
+	for _, module := range build.Modules {
+		src := build.ModulePath(module)
+		dst := fmt.Sprintf("%s/%s", dir, module.File)
+
+		srcInfo, err := os.Stat(src)
 		if err != nil {
 			return err
 		}
-		defer source.Close()
+		action := PlanAction{
+			Stage:  StageCopy,
+			Kind:   PlanCreateFile,
+			Path:   dst,
+			Size:   srcInfo.Size(),
+			SHA256: module.SHA256,
+		}
+		if exists, err := isFileExists(dst); err != nil {
+			return err
+		} else if exists {
+			digest, err := catalog.FileSHA256(dst)
+			if err != nil {
+				return err
+			}
+			action.Kind = PlanOverwriteFile
+			if digest == module.SHA256 {
+				action.Kind = PlanUnchangedFile
+			}
+		}
+		i.Plan.add(action)
+	}
+	return nil
+}
 
-		destination, err := os.Create(dst)
+// ValidateKernelMods checks the ELF machine type and vermagic of every mod in
+// the chosen build against the host, so a mod built for another kernel is
+// refused before it reaches the host
+func (i *DRBDKernelModInstaller) ValidateKernelMods() error {
+	return i.validateBuild(i.Build, i.Kernel.Original)
+}
+
+func (i *DRBDKernelModInstaller) validateBuild(build *catalog.Build, kernel string) error {
+	hostFlags := hostVerMagicFlags(kernel)
+	for _, module := range build.Modules {
+		info, err := kmod.ReadModInfo(build.ModulePath(module))
 		if err != nil {
 			return err
 		}
-		defer destination.Close()
-		_, err = io.Copy(destination, source)
-		if err != nil {
+		if err := info.CheckHost(kernel, i.Machine, hostFlags, i.Config.StrictVerMagic); err != nil {
 			return err
 		}
+		log.WithFields(log.Fields{
+			"mod":        info.Name,
+			"version":    info.Version,
+			"srcversion": info.SrcVersion,
+			"vermagic":   info.VerMagic,
+			"depends":    info.Depends,
+		}).Debug("DRBD kernel mod fits host")
 	}
 	return nil
 }
 
-func (i *DRBDKernelModInstaller) Depmod() error {
-	cmd := exechelper.ExecParams{
-		CmdName: DepmodCMD,
-		Timeout: 300,
+// hostVerMagicFlags returns the vermagic flags of kernel, e.g. "SMP
+// mod_unload modversions", read from an in-tree mod of kernel on host. It
+// returns an empty string, so the flags aren't checked, if there is none
+func hostVerMagicFlags(kernel string) string {
+	file, err := os.Open(fmt.Sprintf(ModulesDepPathTemplate, kernel))
+	if err != nil {
+		log.WithError(err).Warnf("Failed to read modules.dep of kernel %s, vermagic flags can't be checked", kernel)
+		return ""
+	}
+	defer file.Close()
+	modules, err := kmod.ParseModulesDep(file)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to parse modules.dep of kernel %s, vermagic flags can't be checked", kernel)
+		return ""
+	}
+
+	var paths []string
+	for _, path := range modules {
+		if strings.HasPrefix(path, "kernel/") {
+			paths = append(paths, path)
+		}
 	}
+	if len(paths) == 0 {
+		log.Warnf("No in-tree mod of kernel %s found, vermagic flags can't be checked", kernel)
+		return ""
+	}
+	sort.Strings(paths)
 
+	// modinfo of host reads compressed mods as well
 	exec := nsexecutor.New()
-	execRst := exec.RunCommand(cmd)
+	execRst := exec.RunCommand(exechelper.ExecParams{
+		CmdName: ModinfoCMD,
+		CmdArgs: []string{"-F", "vermagic", filepath.Join(LibModulesDir, kernel, paths[0])},
+	})
 	if execRst.ExitCode != 0 {
-		return fmt.Errorf("%w(%s)", execRst.Error, execRst.ErrBuf.Bytes())
+		log.WithError(execRst.Error).Warnf("Failed to read vermagic of %s, vermagic flags can't be checked", paths[0])
+		return ""
 	}
-	return nil
+	_, flags := kmod.SplitVerMagic(execRst.OutBuf.String())
+	log.WithFields(log.Fields{"kernel": kernel, "flags": flags}).Debug("Host kernel vermagic flags")
+	return flags
 }
 
-func (i *DRBDKernelModInstaller) Modprobe() error {
-	files, err := ioutil.ReadDir(i.KernelModToHostPath)
+// CheckSymbolCRCs compares the symbol CRCs in __versions of every mod in the
+// chosen build with the ones exported by the host kernel, reporting unknown
+// symbols and CRC mismatches that would make loading the mods fail. Without a
+// symvers file on host, the CRCs are unknown and it only warns of symbols
+// missing from kallsyms
+func (i *DRBDKernelModInstaller) CheckSymbolCRCs() error {
+	provided := map[string]bool{}
+	for _, module := range i.Build.Modules {
+		symbols, err := kmod.ReadExportedSymbols(i.Build.ModulePath(module))
+		if err != nil {
+			return err
+		}
+		for _, symbol := range symbols {
+			provided[symbol] = true
+		}
+	}
+
+	hostCRCs, source, err := i.readHostSymvers()
 	if err != nil {
 		return err
 	}
-
-	for _, file := range files {
-		modName := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
-		cmd := exechelper.ExecParams{
-			CmdName: ModprobeCMD,
-			CmdArgs: []string{modName},
+	if hostCRCs == nil {
+		return i.checkSymbolsInKallsyms(provided)
+	}
+	log.Infof("checking DRBD kernel mods symbol CRCs against %s", source)
+	for _, module := range i.Build.Modules {
+		if err := kmod.CheckSymbolCRCs(i.Build.ModulePath(module), hostCRCs, provided); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		exec := nsexecutor.New()
-		execRst := exec.RunCommand(cmd)
+// readHostSymvers returns the symbol CRCs of the first symvers file found on
+// host, nil if there is none
+func (i *DRBDKernelModInstaller) readHostSymvers() (map[string]uint32, string, error) {
+	exec := nsexecutor.New()
+	for _, src := range hostSymversSources {
+		path := fmt.Sprintf(src.pathTemplate, i.Kernel.Original)
+		execRst := exec.RunCommand(exechelper.ExecParams{
+			CmdName: src.cmd,
+			CmdArgs: []string{path},
+		})
 		if execRst.ExitCode != 0 {
-			return fmt.Errorf("%w(%s)", execRst.Error, execRst.ErrBuf.Bytes())
+			log.WithError(execRst.Error).Debugf("no symvers found at %s", path)
+			continue
 		}
-		log.Infof("%s has being successfully installed on host", modName)
+		crcs, err := kmod.ParseSymvers(execRst.OutBuf)
+		if err != nil {
+			return nil, "", err
+		}
+		return crcs, path, nil
 	}
-	return nil
+	return nil, "", nil
 }
 
-func (i *DRBDKernelModInstaller) parseKernelVersionAndRelease() error {
-	var uname syscall.Utsname
-	if err := syscall.Uname(&uname); err != nil {
+// checkSymbolsInKallsyms looks the symbols imported by the mods up in the
+// exports of kallsyms. kallsyms only knows symbols of loaded mods, so missing
+// ones may be exported by a dependency not loaded yet like libcrc32c, and are
+// only warned of
+func (i *DRBDKernelModInstaller) checkSymbolsInKallsyms(provided map[string]bool) error {
+	kallsymsCmd := exechelper.ExecParams{
+		CmdName: CatCMD,
+		CmdArgs: []string{KallsymsPath},
+	}
+	execRst := nsexecutor.New().RunCommand(kallsymsCmd)
+	if execRst.ExitCode != 0 {
+		return &CommandError{Command: nsexecutor.CommandLine(kallsymsCmd), Err: execRst.Error, Stderr: execRst.ErrBuf.String()}
+	}
+	exported, err := kmod.ParseKallsymsExports(execRst.OutBuf)
+	if err != nil {
 		return err
 	}
-
-	versionReleaseStr := int8ToStr(uname.Release[:])
-	splitedVersionReleaseStr := strings.Split(versionReleaseStr, "-")
-	if len(splitedVersionReleaseStr) < 2 {
-		return fmt.Errorf("failed to parse kernel version and release. origin string is %q", splitedVersionReleaseStr)
+	if len(exported) == 0 {
+		log.Warnf("No symvers file nor exported symbols in %s found on host, DRBD kernel mods symbols can't be checked", KallsymsPath)
+		return nil
 	}
 
-	version := splitedVersionReleaseStr[0]
-	splitedReleaseStr := strings.Split(splitedVersionReleaseStr[1], ".")
+	log.Warnf("No symvers file found on host, DRBD kernel mods symbol CRCs are unknown, only checking symbols exist in %s", KallsymsPath)
+	for _, module := range i.Build.Modules {
+		err := kmod.CheckSymbols(i.Build.ModulePath(module), exported, provided)
+		if checkErr, ok := err.(*kmod.SymbolCheckError); ok {
+			log.WithField("symbols", checkErr.UnknownSymbols).Warnf("%s imports symbols not exported by host kernel nor loaded mods", module.File)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	i.KernelVersion = version
-	i.KernelRelease = splitedReleaseStr[0]
-	i.KernelVersionReleaseOriginString = versionReleaseStr
+func (i *DRBDKernelModInstaller) Depmod() error {
+	cmd := exechelper.ExecParams{
+		CmdName: DepmodCMD,
+		Timeout: 300,
+	}
 
-	return nil
+	return i.runHostCommand(StageDepmod, cmd)
 }
 
-func (i *DRBDKernelModInstaller) EnsureAutoLoadWhenHostRestarted() error {
-	exists, err := isFileExists(DRBDAutoloaderFile)
+func (i *DRBDKernelModInstaller) Modprobe() error {
+	modNames, err := i.installedModNames()
 	if err != nil {
 		return err
 	}
-	if exists {
-		return nil
+	if err := i.checkDRBDResolution(); err != nil {
+		return err
 	}
 
-	autoloader, err := os.Create(DRBDAutoloaderFile)
-	if err != nil {
+	if load, err := i.prepareUpgrade(); err != nil {
 		return err
+	} else if !load {
+		return nil
 	}
-	defer autoloader.Close()
+	i.markModsChanged()
 
-	if _, err := autoloader.Write([]byte(DRBDAutoloader)); err != nil {
+	for _, modName := range modNames {
+		cmd := exechelper.ExecParams{
+			CmdName: ModprobeCMD,
+			CmdArgs: append([]string{modName}, i.Config.ModuleParams.Args(modName)...),
+		}
+
+		if err := i.runHostCommand(StageModprobe, cmd); err != nil {
+			return err
+		}
+		if i.Plan == nil {
+			log.Infof("%s has being successfully installed on host", modName)
+		}
+	}
+	return i.verifyLoadedSrcVersions()
+}
+
+func (i *DRBDKernelModInstaller) parseKernelVersionAndRelease() error {
+	// the fields of syscall.Utsname are int8 or uint8 depending on the arch,
+	// they're bytes on every arch in unix.Utsname
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
 		return err
 	}
 
-	if err := os.Chmod(DRBDAutoloaderFile, 0755); err != nil {
+	kernel, err := kernelversion.Parse(bytesToStr(uname.Release[:]))
+	if err != nil {
 		return err
 	}
+
+	i.Kernel = kernel
+	// runtime.GOARCH is the arch of this binary, the host may differ, e.g. an
+	// amd64 image running under emulation
+	i.Machine = bytesToStr(uname.Machine[:])
+	i.Arch = arch.Canonical(i.Machine)
+	return nil
+}
+
+// runHostCommand runs the command in the host namespaces, or only records it
+// in dry-run mode
+func (i *DRBDKernelModInstaller) runHostCommand(stage string, cmd exechelper.ExecParams) error {
+	if i.Plan != nil {
+		i.Plan.add(PlanAction{
+			Stage:   stage,
+			Kind:    PlanRunCommand,
+			Command: nsexecutor.CommandLine(cmd),
+		})
+		return nil
+	}
+
+	exec := nsexecutor.New()
+	execRst := exec.RunCommand(cmd)
+	if execRst.ExitCode != 0 {
+		return &CommandError{Command: nsexecutor.CommandLine(cmd), Err: execRst.Error, Stderr: execRst.ErrBuf.String()}
+	}
 	return nil
 }
 
@@ -207,13 +544,10 @@ func isFileExists(path string) (bool, error) {
 	return true, nil
 }
 
-func int8ToStr(arr []int8) string {
-	b := make([]byte, 0, len(arr))
-	for _, v := range arr {
-		if v == 0x00 {
-			break
-		}
-		b = append(b, byte(v))
+// bytesToStr converts a NUL terminated C string
+func bytesToStr(arr []byte) string {
+	if idx := bytes.IndexByte(arr, 0); idx >= 0 {
+		arr = arr[:idx]
 	}
-	return string(b)
+	return string(arr)
 }
@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hwameistor/drbd-installer/pkg/kernelversion"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestHasSuitableDRBDKernelModBuildsLogsChangedSelectionOnly(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.StandardLogger()
+	output, level := logger.Out, logger.GetLevel()
+	logger.SetOutput(buf)
+	logger.SetLevel(log.InfoLevel)
+	defer func() {
+		logger.SetOutput(output)
+		logger.SetLevel(level)
+	}()
+
+	policy, _ := NewMatchPolicy(MatchPolicySameABI, 0)
+	installer := &DRBDKernelModInstaller{
+		OS:     "linux",
+		Arch:   "amd64",
+		Kernel: kernelversion.MustParse("3.10.0-1160.83.1.el7.x86_64"),
+		Policy: policy,
+		Config: Config{KernelModsDir: "../../kernel-mods"},
+	}
+
+	// every reconcile pass selects the build again
+	for pass := 0; pass < 3; pass++ {
+		if !installer.HasSuitableDRBDKernelModBuilds() {
+			t.Fatal("HasSuitableDRBDKernelModBuilds() = false")
+		}
+	}
+	if count := strings.Count(buf.String(), "Rejected DRBD kernel mods build"); count != 1 {
+		t.Errorf("rejection logged %d times at info level, want once", count)
+	}
+	if count := strings.Count(buf.String(), "Chose DRBD kernel mods build"); count != 1 {
+		t.Errorf("chosen build logged %d times at info level, want once", count)
+	}
+
+	// the host boots into another kernel, so the selection changes
+	buf.Reset()
+	installer.Kernel = kernelversion.MustParse("3.10.0-1062.el7.x86_64")
+	if installer.HasSuitableDRBDKernelModBuilds() {
+		t.Fatal("HasSuitableDRBDKernelModBuilds() = true, want no build")
+	}
+	if count := strings.Count(buf.String(), "Rejected DRBD kernel mods build"); count != 2 {
+		t.Errorf("rejections logged %d times at info level, want 2", count)
+	}
+}
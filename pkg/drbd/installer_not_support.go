@@ -1,36 +1,94 @@
+//go:build !linux
 // +build !linux
 
 package drbd
 
 import (
 	"fmt"
+
+	"github.com/hwameistor/drbd-installer/pkg/catalog"
 )
 
 type DRBDKernelModInstaller struct {
+	Build          *catalog.Build
+	Config         Config
+	UpgradePending bool
+	Plan           *Plan
+}
+
+func NewDRBDKernelModInstaller(config Config) (*DRBDKernelModInstaller, error) {
+	return nil, fmt.Errorf("NOT SUPPORT")
+}
+
+func (i *DRBDKernelModInstaller) Install() *RunResult {
+	return &RunResult{Stages: []StageResult{{Stage: StageNewInstaller, Error: "NOT SUPPORT", err: fmt.Errorf("NOT SUPPORT")}}}
 }
 
-func NewDRBDKernelModInstaller() (*DRBDKernelModInstaller, error) {
-	return nil, nil
+func (i *DRBDKernelModInstaller) AddStageObserver(observer func(StageEvent)) {
 }
 
 func (i *DRBDKernelModInstaller) HasSuitableDRBDKernelModBuilds() bool {
 	return false
 }
 
-func (i *DRBDKernelModInstaller) CopyKernelModToHost() error {
+func (i *DRBDKernelModInstaller) CopyKernelModToHost() ([]FileResult, error) {
+	return nil, fmt.Errorf("NOT SUPPORT")
+}
+
+func (i *DRBDKernelModInstaller) ValidateKernelMods() error {
 	return fmt.Errorf("NOT SUPPORT")
 }
 
+func (i *DRBDKernelModInstaller) CheckSymbolCRCs() error {
+	return fmt.Errorf("NOT SUPPORT")
+}
+
+func (i *DRBDKernelModInstaller) EnsureDepmodOverride() (FileResult, error) {
+	return FileResult{}, fmt.Errorf("NOT SUPPORT")
+}
+
 func (i *DRBDKernelModInstaller) Depmod() error {
 	return fmt.Errorf("NOT SUPPORT")
 }
 
+func (i *DRBDKernelModInstaller) EnsureModprobeConf() (FileResult, error) {
+	return FileResult{}, fmt.Errorf("NOT SUPPORT")
+}
+
+func (i *DRBDKernelModInstaller) ApplyModuleParams() ([]ParamChange, error) {
+	return nil, fmt.Errorf("NOT SUPPORT")
+}
+
 func (i *DRBDKernelModInstaller) Modprobe() error {
 	return fmt.Errorf("NOT SUPPORT")
 }
 
-func (i *DRBDKernelModInstaller) EnsureAutoLoadWhenHostRestarted() error {
-	return nil
+func (i *DRBDKernelModInstaller) StageInstalledKernels() ([]KernelStageResult, error) {
+	return nil, fmt.Errorf("NOT SUPPORT")
+}
+
+func (i *DRBDKernelModInstaller) InstallKernelHook() ([]FileResult, error) {
+	return nil, fmt.Errorf("NOT SUPPORT")
+}
+
+func (i *DRBDKernelModInstaller) StageKernel(release string) (KernelStageResult, error) {
+	return KernelStageResult{}, fmt.Errorf("NOT SUPPORT")
+}
+
+func (i *DRBDKernelModInstaller) EnsureAutoLoadWhenHostRestarted() (AutoloaderResult, error) {
+	return AutoloaderResult{}, nil
+}
+
+func (i *DRBDKernelModInstaller) Uninstall() error {
+	return fmt.Errorf("NOT SUPPORT")
+}
+
+func (i *DRBDKernelModInstaller) UnloadKernelMods() error {
+	return fmt.Errorf("NOT SUPPORT")
+}
+
+func (i *DRBDKernelModInstaller) Status() (*Status, error) {
+	return nil, fmt.Errorf("NOT SUPPORT")
 }
 
 func (i *DRBDKernelModInstaller) parseKernelVersionAndRelease() error {
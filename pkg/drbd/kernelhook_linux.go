@@ -0,0 +1,196 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hwameistor/drbd-installer/pkg/arch"
+	"github.com/hwameistor/drbd-installer/pkg/catalog"
+	"github.com/hwameistor/drbd-installer/pkg/kernelversion"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CatalogCacheDirName and BinDirName are dirs in Config.StateDir holding
+	// the catalog subset and the installer binary run by the kernel hooks
+	CatalogCacheDirName = "catalog"
+	BinDirName          = "bin"
+	InstallerBinName    = "drbd-installer"
+
+	// PostinstHookFile is run by the kernel packages of Debian and legacy
+	// RHEL, KernelInstallHookFile by systemd kernel-install. The latter goes
+	// to /etc as /usr/lib belongs to the distro and may be read-only, while
+	// kernel-install runs both
+	PostinstHookFile      = "kernel/postinst.d/drbd-installer"
+	KernelInstallHookFile = "kernel/install.d/90-drbd-installer.install"
+
+	KernelHookFileMode = 0755
+)
+
+func (i *DRBDKernelModInstaller) catalogCacheDir() string {
+	return filepath.Join(i.Config.StateDir, CatalogCacheDirName)
+}
+
+func (i *DRBDKernelModInstaller) installerBinPath() string {
+	return filepath.Join(i.Config.StateDir, BinDirName, InstallerBinName)
+}
+
+func (i *DRBDKernelModInstaller) kernelHookPaths() []string {
+	return []string{
+		filepath.Join(i.Config.HostEtcDir, PostinstHookFile),
+		filepath.Join(i.Config.HostEtcDir, KernelInstallHookFile),
+	}
+}
+
+// InstallKernelHook installs hooks run by the host when a kernel package is
+// installed, which place DRBD kernel mods for the new kernel and run depmod
+// for it without the container. The hooks run a copy of the installer on a
+// cached subset of the catalog for the host OS and arch, both kept in
+// Config.StateDir. It requires HasSuitableDRBDKernelModBuilds to have loaded
+// the catalog
+func (i *DRBDKernelModInstaller) InstallKernelHook() ([]FileResult, error) {
+	if err := i.cacheCatalog(); err != nil {
+		return nil, err
+	}
+	if err := i.copyInstallerBin(); err != nil {
+		return nil, err
+	}
+
+	var results []FileResult
+	for idx, path := range i.kernelHookPaths() {
+		result, err := i.ensureManagedHostFile(StageKernelHook, path, i.renderKernelHook(idx == 1), KernelHookFileMode)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// renderKernelHook renders the postinst.d hook, called with the kernel version
+// as first argument, or the kernel-install one, called with the command and
+// then the kernel version. Failures are reported but never fail the kernel
+// package install
+func (i *DRBDKernelModInstaller) renderKernelHook(kernelInstall bool) string {
+	// the hooks run on host, where the host /etc is /etc
+	command := fmt.Sprintf(`%s stage-kernel -kernel-mods-dir=%s -match-policy=%s -match-max-release-distance=%d -host-etc-dir=%s -debug=false "$KERNEL_VERSION" ||
+    echo "drbd-installer: failed to install DRBD kernel mods for $KERNEL_VERSION" >&2`,
+		i.installerBinPath(), i.catalogCacheDir(), i.Policy.Name(), i.Config.MaxReleaseDistance, HostEtcDir)
+
+	lines := []string{"#!/bin/sh"}
+	if kernelInstall {
+		lines = append(lines,
+			`[ "$1" = "add" ] || exit 0`,
+			`KERNEL_VERSION="$2"`)
+	} else {
+		lines = append(lines, `KERNEL_VERSION="$1"`)
+	}
+	lines = append(lines, splitLines(command)...)
+	lines = append(lines, "exit 0")
+	return strings.Join(withManagedHeader(lines, 1), "\n") + "\n"
+}
+
+// cacheCatalog replaces the cached catalog with the builds for the host OS
+// and arch
+func (i *DRBDKernelModInstaller) cacheCatalog() error {
+	var builds []*catalog.Build
+	for _, build := range i.Catalog.Builds {
+		if build.OS == i.OS && arch.Equal(build.Arch, i.Arch) {
+			builds = append(builds, build)
+		}
+	}
+
+	dir := i.catalogCacheDir()
+	if i.Plan != nil {
+		i.Plan.add(PlanAction{
+			Stage: StageKernelHook,
+			Kind:  PlanCreateFile,
+			Path:  dir,
+			Note:  fmt.Sprintf("cache %d DRBD kernel mods builds for %s/%s", len(builds), i.OS, i.Arch),
+		})
+		return nil
+	}
+
+	tmp, err := ioutil.TempDir(i.Config.StateDir, "."+CatalogCacheDirName+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := catalog.Write(tmp, builds); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"dir": dir, "builds": len(builds)}).Info("DRBD kernel mods catalog cached for kernel hooks")
+	return nil
+}
+
+// copyInstallerBin copies the running binary to host, it's statically linked
+func (i *DRBDKernelModInstaller) copyInstallerBin() error {
+	src, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dst := i.installerBinPath()
+	if i.Plan != nil {
+		i.Plan.add(PlanAction{Stage: StageKernelHook, Kind: PlanCreateFile, Path: dst, Mode: "0755"})
+		return nil
+	}
+
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, source, 0755)
+}
+
+// StageKernel installs DRBD kernel mods for the kernel release, which may not
+// be the running one, and runs depmod for it. It's run by the kernel hooks on
+// host
+func (i *DRBDKernelModInstaller) StageKernel(release string) (KernelStageResult, error) {
+	kernel, err := kernelversion.Parse(release)
+	if err != nil {
+		return KernelStageResult{Kernel: release}, err
+	}
+	if i.Catalog == nil {
+		if i.Catalog, err = catalog.Load(i.Config.KernelModsDir); err != nil {
+			return KernelStageResult{Kernel: release}, err
+		}
+	}
+
+	result := i.stageKernel(kernel)
+	if result.Error != "" {
+		return result, fmt.Errorf("%s", result.Error)
+	}
+	return result, nil
+}
+
+// removeKernelHook removes the kernel hooks, the cached catalog and the
+// installer binary from host
+func (i *DRBDKernelModInstaller) removeKernelHook() error {
+	for _, path := range i.kernelHookPaths() {
+		if err := i.removeManagedHostFile(path); err != nil {
+			return err
+		}
+	}
+	for _, path := range []string{i.catalogCacheDir(), filepath.Dir(i.installerBinPath())} {
+		if err := i.removeHostFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
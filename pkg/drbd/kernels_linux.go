@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hwameistor/drbd-installer/pkg/exechelper"
+	"github.com/hwameistor/drbd-installer/pkg/kernelversion"
+	log "github.com/sirupsen/logrus"
+)
+
+// LibModulesDir holds a dir of kernel mods for every kernel installed on host
+const LibModulesDir = "/lib/modules"
+
+// installedKernels lists the kernels installed on host other than the running
+// one, i.e. the dirs in LibModulesDir with in-tree mods. Dirs left over by
+// removed kernels only hold extra mods and are skipped
+func (i *DRBDKernelModInstaller) installedKernels() ([]*kernelversion.KernelRelease, error) {
+	dirs, err := ioutil.ReadDir(LibModulesDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var kernels []*kernelversion.KernelRelease
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == i.Kernel.Original {
+			continue
+		}
+		if exists, err := isFileExists(filepath.Join(LibModulesDir, dir.Name(), "kernel")); err != nil {
+			return nil, err
+		} else if !exists {
+			continue
+		}
+		kernel, err := kernelversion.Parse(dir.Name())
+		if err != nil {
+			log.WithError(err).Debugf("Skip %s which is not a kernel", dir.Name())
+			continue
+		}
+		kernels = append(kernels, kernel)
+	}
+	sort.Slice(kernels, func(a, b int) bool { return kernels[a].Less(kernels[b]) })
+	return kernels, nil
+}
+
+// StageInstalledKernels installs DRBD kernel mods for every kernel installed
+// on host besides the running one, so the node comes up with DRBD when it
+// reboots into any of them. It requires HasSuitableDRBDKernelModBuilds to
+// have loaded the catalog. A kernel without a build or failing to install is
+// reported in its result and doesn't fail the others
+func (i *DRBDKernelModInstaller) StageInstalledKernels() ([]KernelStageResult, error) {
+	kernels, err := i.installedKernels()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []KernelStageResult
+	for _, kernel := range kernels {
+		result := i.stageKernel(kernel)
+		logCtx := log.WithFields(log.Fields{"kernel": result.Kernel, "build": result.Build})
+		if result.Error != "" {
+			logCtx.WithField("error", result.Error).Warn("DRBD won't be available when host boots into this kernel")
+		} else {
+			logCtx.Info("DRBD kernel mods have being successfully staged")
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (i *DRBDKernelModInstaller) stageKernel(kernel *kernelversion.KernelRelease) KernelStageResult {
+	result := KernelStageResult{Kernel: kernel.Original}
+
+	build, _ := SelectBuild(i.Policy, kernel, i.OS, i.Arch, i.Catalog.Builds)
+	if build == nil {
+		result.Error = ErrNoSuitableBuild.Error()
+		return result
+	}
+	result.Build = build.String()
+	result.DRBDVersion = build.DRBDVersion
+
+	files, err := i.copyBuild(build, kernel.Original, strings.ToLower(fmt.Sprintf(LibModulesPathTemplate, kernel.Original)))
+	result.Files = files
+	if err == nil {
+		err = i.runHostCommand(StageInstalledKernels, exechelper.ExecParams{
+			CmdName: DepmodCMD,
+			CmdArgs: []string{kernel.Original},
+			Timeout: 300,
+		})
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// removeInstalledKernelsMods removes DRBD kernel mods of the kernels other
+// than the running one and regenerates their dependencies
+func (i *DRBDKernelModInstaller) removeInstalledKernelsMods() error {
+	kernels, err := i.installedKernels()
+	if err != nil {
+		return err
+	}
+
+	for _, kernel := range kernels {
+		dir := strings.ToLower(fmt.Sprintf(LibModulesPathTemplate, kernel.Original))
+		if exists, err := isFileExists(dir); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+
+		log.Infof("start removing DRBD kernel mods in %s", dir)
+		if err := i.removeHostFile(dir); err != nil {
+			return err
+		}
+		if err := i.runHostCommand(StageUninstall, exechelper.ExecParams{
+			CmdName: DepmodCMD,
+			CmdArgs: []string{kernel.Original},
+			Timeout: 300,
+		}); err != nil {
+			return err
+		}
+		log.Infof("%s has being successfully removed from host", dir)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hwameistor/drbd-installer/pkg/catalog"
+	"github.com/hwameistor/drbd-installer/pkg/kmod"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ModulesDepPathTemplate     = "/lib/modules/%s/modules.dep"
+	ModulesBuiltinPathTemplate = "/lib/modules/%s/modules.builtin"
+)
+
+// installedModNames returns the mods to load, each after the ones it depends
+// on according to modinfo, keeping the order declared by the catalog otherwise
+func (i *DRBDKernelModInstaller) installedModNames() ([]string, error) {
+	mods, err := i.modsToLoad()
+	if err != nil {
+		return nil, err
+	}
+	return sortedModNames(mods)
+}
+
+// CheckExternalDepends verifies every dependency of the chosen build out of
+// it, e.g. libcrc32c, is known to the host kernel, so a build the host can't
+// load is refused before anything is copied. The result is recorded in the
+// plan in dry-run mode
+func (i *DRBDKernelModInstaller) CheckExternalDepends() error {
+	mods, err := i.modsToLoad()
+	if err != nil {
+		return err
+	}
+	err = i.checkExternalDepends(mods)
+
+	if i.Plan != nil {
+		var deps []string
+		for dep := range kmod.ExternalDepends(mods) {
+			deps = append(deps, dep)
+		}
+		sort.Strings(deps)
+		action := PlanAction{
+			Stage: StageCheckDepends,
+			Kind:  PlanCheck,
+			Note:  fmt.Sprintf("dependencies %s found in host kernel %s", strings.Join(deps, ", "), i.Kernel.Original),
+		}
+		if len(deps) == 0 {
+			action.Note = "no dependencies out of the build"
+		}
+		if err != nil {
+			action.Note = err.Error()
+		}
+		i.Plan.add(action)
+	}
+	return err
+}
+
+func sortedModNames(mods []*kmod.ModInfo) ([]string, error) {
+	sorted, err := kmod.SortByDependencies(mods)
+	if err != nil {
+		return nil, err
+	}
+
+	var modNames []string
+	for _, mod := range sorted {
+		modNames = append(modNames, mod.Name)
+	}
+	log.WithField("order", modNames).Debug("DRBD kernel mods load order")
+	return modNames, nil
+}
+
+// modsToLoad reads the modinfo of the chosen build's mods in catalog order,
+// or of the *.ko files in KernelModToHostPath if there is no build
+func (i *DRBDKernelModInstaller) modsToLoad() ([]*kmod.ModInfo, error) {
+	var mods []*kmod.ModInfo
+	if i.Build != nil {
+		for _, module := range i.Build.Modules {
+			info, err := kmod.ReadModInfo(i.Build.ModulePath(module))
+			if err != nil {
+				return nil, err
+			}
+			info.Name = module.Name
+			mods = append(mods, info)
+		}
+		return mods, nil
+	}
+
+	files, err := ioutil.ReadDir(i.KernelModToHostPath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].Name() < files[b].Name() })
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != catalog.KernelModExt {
+			continue
+		}
+		info, err := kmod.ReadModInfo(filepath.Join(i.KernelModToHostPath, file.Name()))
+		if err != nil {
+			log.WithError(err).Warnf("Skip %s which is not a kernel mod", file.Name())
+			continue
+		}
+		info.Name = strings.TrimSuffix(file.Name(), catalog.KernelModExt)
+		mods = append(mods, info)
+	}
+	return mods, nil
+}
+
+// checkExternalDepends verifies every dependency out of mods is a mod known
+// to modules.dep or built into the host kernel
+func (i *DRBDKernelModInstaller) checkExternalDepends(mods []*kmod.ModInfo) error {
+	external := kmod.ExternalDepends(mods)
+	if len(external) == 0 {
+		return nil
+	}
+
+	available, err := readModulesFile(fmt.Sprintf(ModulesDepPathTemplate, i.Kernel.Original), func(reader io.Reader) (map[string]bool, error) {
+		modules, err := kmod.ParseModulesDep(reader)
+		names := map[string]bool{}
+		for name := range modules {
+			names[name] = true
+		}
+		return names, err
+	})
+	if err != nil {
+		return err
+	}
+	builtin, err := readModulesFile(fmt.Sprintf(ModulesBuiltinPathTemplate, i.Kernel.Original), kmod.ParseModulesBuiltin)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for dep, requiredBy := range external {
+		if !available[dep] && !builtin[dep] {
+			missing = append(missing, fmt.Sprintf("%s (required by %s)", dep, strings.Join(requiredBy, ", ")))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing dependencies of DRBD kernel mods on host kernel %s: %s", i.Kernel.Original, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// readModulesFile parses a modules.* file of the host kernel, a missing file
+// is treated as empty
+func readModulesFile(path string, parse func(reader io.Reader) (map[string]bool, error)) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parse(file)
+}
@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ManagedFileMode is the mode of config files generated on host
+const ManagedFileMode = 0644
+
+// ensureManagedHostFile writes desired, which carries the managed header, to
+// path on host with mode, or removes path if desired is empty. A file without
+// the managed header was written by someone else and is kept unless
+// Config.Force is set, and it's never removed
+func (i *DRBDKernelModInstaller) ensureManagedHostFile(stage, path, desired string, mode os.FileMode) (FileResult, error) {
+	result := FileResult{Path: path, Action: FileUnchanged}
+
+	current, exists, err := readFileIfExists(path)
+	if err != nil || current == desired || (!exists && desired == "") {
+		return result, err
+	}
+	if exists {
+		result.Action = FileUpdated
+		if desired == "" {
+			result.Action = FileRemoved
+		}
+		if _, digest := withoutManagedHeader(current); digest == "" && desired == "" {
+			result.Action = FileKept
+			log.Warnf("%s is not managed by the installer and nothing is to be written there, keep it", path)
+			return result, nil
+		} else if digest == "" && !i.Config.Force {
+			result.Action = FileKept
+			log.Warnf("%s is not managed by the installer, keep it. Use force to overwrite it", path)
+			return result, nil
+		}
+	} else {
+		result.Action = FileCreated
+	}
+
+	if i.Plan != nil {
+		action := PlanAction{
+			Stage: stage,
+			Kind:  PlanCreateFile,
+			Path:  path,
+			Size:  int64(len(desired)),
+			Mode:  fmt.Sprintf("%04o", mode),
+			Diff:  diffLines(current, desired),
+		}
+		if exists {
+			action.Kind = PlanOverwriteFile
+		}
+		if desired == "" {
+			action = PlanAction{Stage: stage, Kind: PlanRemoveFile, Path: path}
+		}
+		i.Plan.add(action)
+		return result, nil
+	}
+
+	if err := i.trackHostFile(path); err != nil {
+		return result, err
+	}
+	if desired == "" {
+		if err := os.Remove(path); err != nil {
+			return result, err
+		}
+		log.WithField("file", path).Infof("managed file %s", result.Action)
+		return result, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return result, err
+	}
+	if err := writeContentAtomic(path, []byte(desired), mode); err != nil {
+		return result, err
+	}
+	log.WithField("file", path).Infof("managed file %s", result.Action)
+	return result, nil
+}
+
+// removeManagedHostFile removes path from host if it carries the managed
+// header, a file written by someone else is left alone
+func (i *DRBDKernelModInstaller) removeManagedHostFile(path string) error {
+	content, _, err := readFileIfExists(path)
+	if err != nil {
+		return err
+	}
+	if _, digest := withoutManagedHeader(content); digest == "" {
+		return nil
+	}
+
+	log.Infof("start removing %s", path)
+	if err := i.removeHostFile(path); err != nil {
+		return err
+	}
+	log.Infof("%s has being successfully removed from host", path)
+	return nil
+}
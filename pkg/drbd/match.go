@@ -0,0 +1,220 @@
+package drbd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hwameistor/drbd-installer/pkg/arch"
+	"github.com/hwameistor/drbd-installer/pkg/catalog"
+	"github.com/hwameistor/drbd-installer/pkg/kernelversion"
+)
+
+const (
+	MatchPolicyExact        = "exact"
+	MatchPolicySameABI      = "same-abi"
+	MatchPolicyKABIStream   = "kabi-stream"
+	MatchPolicyNearestLower = "nearest-lower"
+)
+
+// MatchPolicy decides whether a build is able to serve the host kernel
+type MatchPolicy interface {
+	Name() string
+	// Match returns an empty string if build fits host, otherwise the reason
+	// why it was rejected
+	Match(host *kernelversion.KernelRelease, build *catalog.Build) string
+}
+
+// MatchRejection records why a candidate build was not chosen
+type MatchRejection struct {
+	Build  *catalog.Build
+	Reason string
+}
+
+// NewMatchPolicy returns the policy by name. maxReleaseDistance is only used
+// by the nearest-lower policy, 0 means unlimited
+func NewMatchPolicy(name string, maxReleaseDistance int) (MatchPolicy, error) {
+	switch name {
+	case MatchPolicyExact:
+		return exactPolicy{}, nil
+	case MatchPolicySameABI, "":
+		return sameABIPolicy{}, nil
+	case MatchPolicyKABIStream:
+		return kabiStreamPolicy{}, nil
+	case MatchPolicyNearestLower:
+		return nearestLowerPolicy{maxReleaseDistance: maxReleaseDistance}, nil
+	}
+	return nil, fmt.Errorf("unknown match policy %q", name)
+}
+
+// SelectBuild picks the build that best fits host from candidates according
+// to policy. Builds of other OS or arch, or declaring a kernel range the host
+// is out of, are rejected before the policy is asked. Arches are compared by
+// their canonical names, so "arm" builds serve "aarch64" hosts. Among the
+// accepted builds, the newest one not newer than the host kernel wins, falling
+// back to the oldest one if all of them are newer
+func SelectBuild(policy MatchPolicy, host *kernelversion.KernelRelease, osName, hostArch string, candidates []*catalog.Build) (*catalog.Build, []MatchRejection) {
+	var (
+		accepted   []*catalog.Build
+		rejections []MatchRejection
+	)
+	for _, build := range candidates {
+		reason := ""
+		switch {
+		case build.OS != osName:
+			reason = fmt.Sprintf("OS %s doesn't match host OS %s", build.OS, osName)
+		case !arch.Equal(build.Arch, hostArch):
+			reason = fmt.Sprintf("arch %s doesn't match host arch %s", build.Arch, hostArch)
+		case build.KernelRange != nil && !build.KernelRange.Contains(host):
+			reason = fmt.Sprintf("host kernel %s is out of range %s", host, build.KernelRange)
+		default:
+			reason = policy.Match(host, build)
+		}
+		if reason != "" {
+			rejections = append(rejections, MatchRejection{Build: build, Reason: reason})
+			continue
+		}
+		accepted = append(accepted, build)
+	}
+	if len(accepted) == 0 {
+		return nil, rejections
+	}
+
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].KernelRelease.Less(accepted[j].KernelRelease)
+	})
+	chosen := accepted[0]
+	for _, build := range accepted {
+		if kernelversion.Compare(build.KernelRelease, host) <= 0 {
+			chosen = build
+		}
+	}
+	for _, build := range accepted {
+		if build != chosen {
+			rejections = append(rejections, MatchRejection{Build: build, Reason: fmt.Sprintf("%s is a better fit", chosen)})
+		}
+	}
+	return chosen, rejections
+}
+
+// exactPolicy requires the build to be made against the very same kernel
+type exactPolicy struct{}
+
+func (exactPolicy) Name() string { return MatchPolicyExact }
+
+func (exactPolicy) Match(host *kernelversion.KernelRelease, build *catalog.Build) string {
+	if reason := matchVersion(host, build); reason != "" {
+		return reason
+	}
+	if build.KernelRelease.Release != host.Release {
+		return fmt.Sprintf("release %s doesn't equal host release %s", build.KernelRelease.Release, host.Release)
+	}
+	if reason := matchDistroTag(host, build); reason != "" {
+		return reason
+	}
+	// builds without a distro tag can't carry a suffix after it
+	if build.KernelRelease.DistroTag != "" && build.KernelRelease.ReleaseSuffix != host.ReleaseSuffix {
+		return fmt.Sprintf("release suffix %q doesn't equal host release suffix %q", build.KernelRelease.ReleaseSuffix, host.ReleaseSuffix)
+	}
+	return matchFlavour(host, build)
+}
+
+// sameABIPolicy accepts builds made against any kernel sharing the upstream
+// version, the ABI number and the flavour with the host, e.g. a 3.10.0-1160
+// build serves 3.10.0-1160.83.1.el7
+type sameABIPolicy struct{}
+
+func (sameABIPolicy) Name() string { return MatchPolicySameABI }
+
+func (sameABIPolicy) Match(host *kernelversion.KernelRelease, build *catalog.Build) string {
+	if reason := matchVersion(host, build); reason != "" {
+		return reason
+	}
+	if build.KernelRelease.ABI() != host.ABI() {
+		return fmt.Sprintf("ABI %s doesn't equal host ABI %s", build.KernelRelease.ABI(), host.ABI())
+	}
+	if reason := matchDistroTag(host, build); reason != "" {
+		return reason
+	}
+	return matchFlavour(host, build)
+}
+
+// kabiStreamPolicy accepts builds made against an older or equal kernel of
+// the same RHEL major release, relying on the kABI being kept stable within
+// it. The kABI only guarantees that mods of older kernels of the stream load
+// into newer ones, and builds without a distro tag have no stream
+type kabiStreamPolicy struct{}
+
+func (kabiStreamPolicy) Name() string { return MatchPolicyKABIStream }
+
+func (kabiStreamPolicy) Match(host *kernelversion.KernelRelease, build *catalog.Build) string {
+	if !host.IsRHELLike() {
+		return fmt.Sprintf("host kernel %s has no RHEL kABI stream", host)
+	}
+	if reason := matchVersion(host, build); reason != "" {
+		return reason
+	}
+	if build.KernelRelease.DistroTag == "" {
+		return fmt.Sprintf("kernel %s has no distro tag to tell its kABI stream", build.KernelRelease)
+	}
+	if build.KernelRelease.DistroFamily() != host.DistroFamily() {
+		return fmt.Sprintf("kABI stream %s doesn't equal host kABI stream %s", build.KernelRelease.DistroFamily(), host.DistroFamily())
+	}
+	if kernelversion.Compare(build.KernelRelease, host) > 0 {
+		return fmt.Sprintf("release %s is newer than host release %s", build.KernelRelease.Release, host.Release)
+	}
+	return matchFlavour(host, build)
+}
+
+// nearestLowerPolicy accepts builds made against an older or equal release of
+// the same upstream version, optionally no more than maxReleaseDistance ABI
+// numbers away from the host
+type nearestLowerPolicy struct {
+	maxReleaseDistance int
+}
+
+func (nearestLowerPolicy) Name() string { return MatchPolicyNearestLower }
+
+func (p nearestLowerPolicy) Match(host *kernelversion.KernelRelease, build *catalog.Build) string {
+	if reason := matchVersion(host, build); reason != "" {
+		return reason
+	}
+	if kernelversion.Compare(build.KernelRelease, host) > 0 {
+		return fmt.Sprintf("release %s is newer than host release %s", build.KernelRelease.Release, host.Release)
+	}
+	if p.maxReleaseDistance > 0 {
+		buildABI, err1 := strconv.Atoi(build.KernelRelease.ABI())
+		hostABI, err2 := strconv.Atoi(host.ABI())
+		if err1 != nil || err2 != nil {
+			return fmt.Sprintf("ABI %s or host ABI %s is not a number", build.KernelRelease.ABI(), host.ABI())
+		}
+		if hostABI-buildABI > p.maxReleaseDistance {
+			return fmt.Sprintf("ABI %d is more than %d away from host ABI %d", buildABI, p.maxReleaseDistance, hostABI)
+		}
+	}
+	if reason := matchDistroTag(host, build); reason != "" {
+		return reason
+	}
+	return matchFlavour(host, build)
+}
+
+func matchVersion(host *kernelversion.KernelRelease, build *catalog.Build) string {
+	if build.KernelRelease.Version() != host.Version() {
+		return fmt.Sprintf("version %s doesn't equal host version %s", build.KernelRelease.Version(), host.Version())
+	}
+	return ""
+}
+
+func matchDistroTag(host *kernelversion.KernelRelease, build *catalog.Build) string {
+	if build.KernelRelease.DistroTag != "" && build.KernelRelease.DistroTag != host.DistroTag {
+		return fmt.Sprintf("distro %s doesn't equal host distro %s", build.KernelRelease.DistroTag, host.DistroTag)
+	}
+	return ""
+}
+
+func matchFlavour(host *kernelversion.KernelRelease, build *catalog.Build) string {
+	if build.KernelRelease.Flavour != "" && build.KernelRelease.Flavour != host.Flavour {
+		return fmt.Sprintf("flavour %s doesn't equal host flavour %s", build.KernelRelease.Flavour, host.Flavour)
+	}
+	return ""
+}
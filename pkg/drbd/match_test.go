@@ -0,0 +1,142 @@
+package drbd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hwameistor/drbd-installer/pkg/catalog"
+	"github.com/hwameistor/drbd-installer/pkg/kernelversion"
+)
+
+const (
+	el7Host    = "3.10.0-1160.83.1.el7.x86_64"
+	el7OldHost = "3.10.0-1062.el7.x86_64"
+	ky10Host   = "4.19.90-23.8.v2101.ky10.aarch64"
+)
+
+func newBuild(kernel, buildArch string) *catalog.Build {
+	return &catalog.Build{
+		OS:            "linux",
+		Arch:          buildArch,
+		Kernel:        kernel,
+		KernelRelease: kernelversion.MustParse(kernel),
+	}
+}
+
+func TestMatchPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy             string
+		maxReleaseDistance int
+		host               string
+		build              string
+		accepted           bool
+	}{
+		{MatchPolicyExact, 0, el7Host, el7Host, true},
+		{MatchPolicyExact, 0, el7Host, "3.10.0-1160.el7.x86_64", false},
+		{MatchPolicyExact, 0, "3.10.0-1160.el7.x86_64", "3.10.0-1160", true},
+		{MatchPolicyExact, 0, el7Host, "3.10.0-1160.83.1.el8.x86_64", false},
+		{MatchPolicyExact, 0, "4.18.0-348.el8.0.2.x86_64", "4.18.0-348.el8.x86_64", false},
+		{MatchPolicyExact, 0, ky10Host, ky10Host, true},
+		{MatchPolicyExact, 0, "5.15.0-105-generic", "5.15.0-105-aws", false},
+
+		{MatchPolicySameABI, 0, el7Host, "3.10.0-1160.el7.x86_64", true},
+		{MatchPolicySameABI, 0, el7Host, "3.10.0-1160", true},
+		{MatchPolicySameABI, 0, el7Host, "3.10.0-1062.el7.x86_64", false},
+		{MatchPolicySameABI, 0, el7OldHost, "3.10.0-1160", false},
+		{MatchPolicySameABI, 0, el7Host, "4.18.0-1160.el8.x86_64", false},
+		{MatchPolicySameABI, 0, ky10Host, "4.19.90-23.7.v2101.ky10.aarch64", true},
+		{MatchPolicySameABI, 0, ky10Host, "4.19.90-24.4.v2101.ky10.aarch64", false},
+
+		{MatchPolicyKABIStream, 0, el7Host, "3.10.0-1062.el7.x86_64", true},
+		{MatchPolicyKABIStream, 0, el7Host, "3.10.0-1160.el7.x86_64", true},
+		{MatchPolicyKABIStream, 0, el7OldHost, "3.10.0-1160.el7.x86_64", false},
+		{MatchPolicyKABIStream, 0, el7OldHost, "3.10.0-1160", false},
+		{MatchPolicyKABIStream, 0, el7OldHost, "3.10.0-957", false},
+		{MatchPolicyKABIStream, 0, "4.18.0-348.el8.x86_64", "4.18.0-305.el8.x86_64", true},
+		{MatchPolicyKABIStream, 0, el7Host, "4.18.0-305.el8.x86_64", false},
+		{MatchPolicyKABIStream, 0, ky10Host, ky10Host, false},
+
+		{MatchPolicyNearestLower, 0, el7Host, "3.10.0-1062.el7.x86_64", true},
+		{MatchPolicyNearestLower, 0, el7Host, el7Host, true},
+		{MatchPolicyNearestLower, 0, el7OldHost, "3.10.0-1160.el7.x86_64", false},
+		{MatchPolicyNearestLower, 50, el7Host, "3.10.0-1062.el7.x86_64", false},
+		{MatchPolicyNearestLower, 50, el7Host, "3.10.0-1127.el7.x86_64", true},
+		{MatchPolicyNearestLower, 0, ky10Host, "4.19.90-23", true},
+		{MatchPolicyNearestLower, 0, ky10Host, "4.19.90-25", false},
+	} {
+		policy, err := NewMatchPolicy(tc.policy, tc.maxReleaseDistance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason := policy.Match(kernelversion.MustParse(tc.host), newBuild(tc.build, "amd64"))
+		if accepted := reason == ""; accepted != tc.accepted {
+			t.Errorf("%s(%d) of %s for host %s accepted = %t (%s), want %t", tc.policy, tc.maxReleaseDistance, tc.build, tc.host, accepted, reason, tc.accepted)
+		}
+	}
+}
+
+func TestNewMatchPolicy(t *testing.T) {
+	policy, err := NewMatchPolicy("", 0)
+	if err != nil || policy.Name() != MatchPolicySameABI {
+		t.Errorf("NewMatchPolicy(\"\") = %v, %v, want %s", policy, err, MatchPolicySameABI)
+	}
+	if _, err := NewMatchPolicy("closest", 0); err == nil {
+		t.Error("NewMatchPolicy(\"closest\") error = nil")
+	}
+}
+
+func TestSelectBuild(t *testing.T) {
+	outOfRange := newBuild("3.10.0-1160.el7.x86_64", "amd64")
+	outOfRange.KernelRange = &catalog.KernelRange{Before: "3.10.0-1160.80"}
+	candidates := []*catalog.Build{
+		newBuild("3.10.0-1160.90.1.el7.x86_64", "amd64"),
+		newBuild("3.10.0-1160.el7.x86_64", "amd64"),
+		newBuild("3.10.0-1160.83.1.el7.x86_64", "x86_64"),
+		newBuild("3.10.0-1160.83.1.el7.aarch64", "arm64"),
+		newBuild("3.10.0-1062.el7.x86_64", "amd64"),
+		outOfRange,
+	}
+	policy, _ := NewMatchPolicy(MatchPolicySameABI, 0)
+
+	chosen, rejections := SelectBuild(policy, kernelversion.MustParse(el7Host), "linux", "amd64", candidates)
+	if chosen != candidates[2] {
+		t.Fatalf("SelectBuild() = %v, want %v", chosen, candidates[2])
+	}
+	reasons := map[*catalog.Build]string{}
+	for _, rejection := range rejections {
+		reasons[rejection.Build] = rejection.Reason
+	}
+	for build, want := range map[*catalog.Build]string{
+		candidates[0]: "is a better fit",
+		candidates[1]: "is a better fit",
+		candidates[3]: "arch arm64 doesn't match",
+		candidates[4]: "ABI 1062 doesn't equal",
+		outOfRange:    "is out of range",
+	} {
+		if !strings.Contains(reasons[build], want) {
+			t.Errorf("rejection of %s = %q, want it to contain %q", build, reasons[build], want)
+		}
+	}
+	if len(rejections) != len(candidates)-1 {
+		t.Errorf("SelectBuild() rejected %d builds, want %d", len(rejections), len(candidates)-1)
+	}
+
+	// all accepted builds are newer than the host, the oldest one wins
+	chosen, _ = SelectBuild(policy, kernelversion.MustParse("3.10.0-1160.el7.x86_64"), "linux", "amd64", candidates[:1])
+	if chosen != candidates[0] {
+		t.Errorf("SelectBuild() = %v, want %v", chosen, candidates[0])
+	}
+
+	if chosen, _ = SelectBuild(policy, kernelversion.MustParse(el7Host), "windows", "amd64", candidates); chosen != nil {
+		t.Errorf("SelectBuild() = %v, want nil", chosen)
+	}
+}
+
+func TestSelectBuildLegacyKABIStream(t *testing.T) {
+	// a legacy layout build of a newer kernel can't serve an older host
+	policy, _ := NewMatchPolicy(MatchPolicyKABIStream, 0)
+	chosen, rejections := SelectBuild(policy, kernelversion.MustParse(el7OldHost), "linux", "amd64", []*catalog.Build{newBuild("3.10.0-1160", "amd64")})
+	if chosen != nil || len(rejections) != 1 {
+		t.Errorf("SelectBuild() = %v, %v, want no build", chosen, rejections)
+	}
+}
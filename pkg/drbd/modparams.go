@@ -0,0 +1,126 @@
+package drbd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hwameistor/drbd-installer/pkg/kmod"
+)
+
+// ModuleParams are the parameters of DRBD kernel mods, by mod name and then
+// parameter name
+type ModuleParams map[string]map[string]string
+
+// ParamChange is a parameter whose value on the loaded mod differs from the
+// configured one
+type ParamChange struct {
+	Module  string `json:"module" yaml:"module"`
+	Param   string `json:"param" yaml:"param"`
+	Value   string `json:"value" yaml:"value"`
+	Current string `json:"current" yaml:"current"`
+	// Applied is true if the value was written to the loaded mod, otherwise
+	// NeedsReload tells it only takes effect once the mod is loaded again
+	Applied     bool `json:"applied" yaml:"applied"`
+	NeedsReload bool `json:"needsReload" yaml:"needsReload"`
+}
+
+var paramNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// ParseModuleParam parses "<mod>.<param>=<value>", e.g. "drbd.minor_count=256"
+func ParseModuleParam(param string) (mod, name, value string, err error) {
+	kv := strings.SplitN(param, "=", 2)
+	modName := strings.SplitN(kv[0], ".", 2)
+	if len(kv) != 2 || len(modName) != 2 {
+		return "", "", "", fmt.Errorf("invalid module parameter %q, expecting <mod>.<param>=<value>", param)
+	}
+	return kmod.NormalizeName(modName[0]), modName[1], kv[1], nil
+}
+
+// Set adds the parameter of mod
+func (p ModuleParams) Set(mod, name, value string) {
+	mod = kmod.NormalizeName(mod)
+	if p[mod] == nil {
+		p[mod] = map[string]string{}
+	}
+	p[mod][name] = value
+}
+
+// Validate refuses names which can't be put in a modprobe.d file or passed
+// on the modprobe command line
+func (p ModuleParams) Validate() error {
+	for mod, params := range p {
+		if !paramNamePattern.MatchString(mod) {
+			return fmt.Errorf("invalid module name %q", mod)
+		}
+		for name, value := range params {
+			if !paramNamePattern.MatchString(name) {
+				return fmt.Errorf("invalid parameter name %q of %s", name, mod)
+			}
+			if strings.ContainsAny(value, "\n\"") {
+				return fmt.Errorf("invalid value %q of %s.%s", value, mod, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Args returns the parameters of mod as modprobe arguments in name order
+func (p ModuleParams) Args(mod string) []string {
+	params := p[kmod.NormalizeName(mod)]
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]string, 0, len(names))
+	for _, name := range names {
+		value := params[name]
+		if strings.ContainsAny(value, " \t") {
+			value = `"` + value + `"`
+		}
+		args = append(args, name+"="+value)
+	}
+	return args
+}
+
+// renderModprobeConf renders the modprobe.d file setting the parameters, empty
+// if there are none
+func renderModprobeConf(params ModuleParams) string {
+	mods := make([]string, 0, len(params))
+	for mod := range params {
+		if len(params[mod]) > 0 {
+			mods = append(mods, mod)
+		}
+	}
+	if len(mods) == 0 {
+		return ""
+	}
+	sort.Strings(mods)
+
+	lines := []string{"# Parameters of DRBD kernel mods"}
+	for _, mod := range mods {
+		lines = append(lines, fmt.Sprintf("options %s %s", mod, strings.Join(params.Args(mod), " ")))
+	}
+	return strings.Join(withManagedHeader(lines, 0), "\n") + "\n"
+}
+
+// sameParamValue compares a configured value with the one read from sysfs,
+// which shows bool parameters as Y or N
+func sameParamValue(value, current string) bool {
+	if value == current {
+		return true
+	}
+	if current != "Y" && current != "N" {
+		return false
+	}
+	switch strings.ToLower(value) {
+	case "1", "y", "yes", "true", "on":
+		return current == "Y"
+	case "0", "n", "no", "false", "off":
+		return current == "N"
+	}
+	return false
+}
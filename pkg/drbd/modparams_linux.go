@@ -0,0 +1,113 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ModprobeConfFile is the modprobe.d file setting DRBD kernel mods parameters,
+// relative to the host /etc
+const ModprobeConfFile = "modprobe.d/drbd.conf"
+
+func (i *DRBDKernelModInstaller) modprobeConfPath() string {
+	return filepath.Join(i.Config.HostEtcDir, ModprobeConfFile)
+}
+
+// EnsureModprobeConf writes the configured mods parameters to the modprobe.d
+// file on host, so they are used whenever the mods are loaded, including on
+// boot. The file is removed if no parameter is configured
+func (i *DRBDKernelModInstaller) EnsureModprobeConf() (FileResult, error) {
+	return i.ensureManagedHostFile(StageModprobeConf, i.modprobeConfPath(), renderModprobeConf(i.Config.ModuleParams), ManagedFileMode)
+}
+
+// ApplyModuleParams compares the configured parameters with the ones of the
+// loaded mods. Parameters writable under /sys/module/<mod>/parameters are
+// changed live, the others are reported as needing a reload. Mods not loaded
+// get the parameters when they are loaded
+func (i *DRBDKernelModInstaller) ApplyModuleParams() ([]ParamChange, error) {
+	mods := make([]string, 0, len(i.Config.ModuleParams))
+	for mod := range i.Config.ModuleParams {
+		mods = append(mods, mod)
+	}
+	sort.Strings(mods)
+
+	var changes []ParamChange
+	for _, mod := range mods {
+		if loaded, err := isFileExists(filepath.Join(SysModulePath, mod)); err != nil {
+			return changes, err
+		} else if !loaded {
+			continue
+		}
+
+		params := i.Config.ModuleParams[mod]
+		names := make([]string, 0, len(params))
+		for name := range params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			change, err := i.applyModuleParam(mod, name, params[name])
+			if err != nil {
+				return changes, err
+			}
+			if change != nil {
+				changes = append(changes, *change)
+			}
+		}
+	}
+	return changes, nil
+}
+
+func (i *DRBDKernelModInstaller) applyModuleParam(mod, name, value string) (*ParamChange, error) {
+	path := filepath.Join(SysModulePath, mod, "parameters", name)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// parameters with perm 0 are not exposed in sysfs at all
+		log.Warnf("%s.%s is not shown in sysfs, it takes effect when %s is loaded again", mod, name, mod)
+		return &ParamChange{Module: mod, Param: name, Value: value, NeedsReload: true}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	current, err := readSysModuleAttr(mod, filepath.Join("parameters", name))
+	if err != nil {
+		return nil, err
+	}
+	if sameParamValue(value, current) {
+		return nil, nil
+	}
+
+	change := &ParamChange{Module: mod, Param: name, Value: value, Current: current}
+	logCtx := log.WithFields(log.Fields{"param": mod + "." + name, "value": value, "current": current})
+	if info.Mode().Perm()&0200 == 0 {
+		change.NeedsReload = true
+		logCtx.Warnf("parameter is read-only, it takes effect when %s is loaded again", mod)
+		return change, nil
+	}
+
+	if i.Plan != nil {
+		i.Plan.add(PlanAction{
+			Stage: StageApplyModuleParams,
+			Kind:  PlanOverwriteFile,
+			Path:  path,
+			Diff:  diffLines(current, value),
+		})
+		change.Applied = true
+		return change, nil
+	}
+	if err := ioutil.WriteFile(path, []byte(value), 0); err != nil {
+		return nil, fmt.Errorf("failed to set %s.%s: %w", mod, name, err)
+	}
+	change.Applied = true
+	logCtx.Info("parameter has being successfully changed")
+	return change, nil
+}
@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureModprobeConfKeepsUnmanagedFile(t *testing.T) {
+	etc := t.TempDir()
+	path := filepath.Join(etc, ModprobeConfFile)
+	content := "options drbd usermode_helper=disabled\n"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), ManagedFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing to write, force must not remove the file written by hand
+	installer := &DRBDKernelModInstaller{Config: Config{HostEtcDir: etc, Force: true}}
+	result, err := installer.EnsureModprobeConf()
+	if err != nil {
+		t.Fatalf("EnsureModprobeConf() error = %v", err)
+	}
+	if result.Action != FileKept {
+		t.Errorf("EnsureModprobeConf() action = %s, want %s", result.Action, FileKept)
+	}
+	if current, err := ioutil.ReadFile(path); err != nil || string(current) != content {
+		t.Errorf("%s = %q, %v, want it kept", path, current, err)
+	}
+}
+
+func TestEnsureModprobeConfRemovesManagedFile(t *testing.T) {
+	etc := t.TempDir()
+	installer := &DRBDKernelModInstaller{Config: Config{
+		HostEtcDir:   etc,
+		ModuleParams: ModuleParams{"drbd": {"usermode_helper": "disabled"}},
+	}}
+	if result, err := installer.EnsureModprobeConf(); err != nil || result.Action != FileCreated {
+		t.Fatalf("EnsureModprobeConf() = %+v, %v, want %s", result, err, FileCreated)
+	}
+
+	installer.Config.ModuleParams = nil
+	if result, err := installer.EnsureModprobeConf(); err != nil || result.Action != FileRemoved {
+		t.Fatalf("EnsureModprobeConf() = %+v, %v, want %s", result, err, FileRemoved)
+	}
+	if exists, _ := isFileExists(filepath.Join(etc, ModprobeConfFile)); exists {
+		t.Errorf("%s is not removed", ModprobeConfFile)
+	}
+}
@@ -0,0 +1,143 @@
+package drbd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Kinds of PlanAction
+const (
+	PlanCreateFile    = "create"
+	PlanOverwriteFile = "overwrite"
+	PlanUnchangedFile = "unchanged"
+	PlanRemoveFile    = "remove"
+	PlanRunCommand    = "run"
+	// PlanCheck is a check of the host made before changing it
+	PlanCheck = "check"
+)
+
+// Plan is what the installer would do on the host in dry-run mode
+type Plan struct {
+	Actions []PlanAction `json:"actions" yaml:"actions"`
+}
+
+// PlanAction is a single change the installer would make to the host
+type PlanAction struct {
+	Stage string `json:"stage" yaml:"stage"`
+	Kind  string `json:"kind" yaml:"kind"`
+	// Path, Size, Mode and SHA256 describe the file to change
+	Path   string `json:"path,omitempty" yaml:"path,omitempty"`
+	Size   int64  `json:"size,omitempty" yaml:"size,omitempty"`
+	Mode   string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	SHA256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	// Diff is the content change of text files
+	Diff string `json:"diff,omitempty" yaml:"diff,omitempty"`
+	// Command is the full command line run on the host
+	Command []string `json:"command,omitempty" yaml:"command,omitempty"`
+	Note    string   `json:"note,omitempty" yaml:"note,omitempty"`
+}
+
+func (p *Plan) add(action PlanAction) {
+	p.Actions = append(p.Actions, action)
+}
+
+// Format renders the plan as text, json or yaml
+func (p *Plan) Format(format string) ([]byte, error) {
+	switch format {
+	case StatusFormatJSON:
+		return json.MarshalIndent(p, "", "  ")
+	case StatusFormatYAML:
+		return yaml.Marshal(p)
+	case StatusFormatText, "":
+		return p.text(), nil
+	}
+	return nil, fmt.Errorf("unknown plan format %q", format)
+}
+
+func (p *Plan) text() []byte {
+	buf := &bytes.Buffer{}
+	for _, action := range p.Actions {
+		fmt.Fprintf(buf, "[%s] %s", action.Stage, action.Kind)
+		if len(action.Command) > 0 {
+			fmt.Fprintf(buf, " %s", strings.Join(action.Command, " "))
+		}
+		if action.Path != "" {
+			fmt.Fprintf(buf, " %s", action.Path)
+		}
+		var details []string
+		if action.Size > 0 {
+			details = append(details, fmt.Sprintf("%d bytes", action.Size))
+		}
+		if action.Mode != "" {
+			details = append(details, "mode "+action.Mode)
+		}
+		if action.SHA256 != "" {
+			details = append(details, "sha256 "+action.SHA256)
+		}
+		if action.Note != "" {
+			details = append(details, action.Note)
+		}
+		if len(details) > 0 {
+			fmt.Fprintf(buf, " (%s)", strings.Join(details, ", "))
+		}
+		buf.WriteString("\n")
+		for _, line := range strings.Split(strings.TrimSuffix(action.Diff, "\n"), "\n") {
+			if line != "" {
+				fmt.Fprintf(buf, "    %s\n", line)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// diffLines returns a line diff turning from into to, with removed lines
+// prefixed by "-", added ones by "+" and common ones by " "
+func diffLines(from, to string) string {
+	a, b := splitLines(from), splitLines(to)
+
+	// lcs[x][y] is the length of the longest common subsequence of a[x:] and b[y:]
+	lcs := make([][]int, len(a)+1)
+	for x := range lcs {
+		lcs[x] = make([]int, len(b)+1)
+	}
+	for x := len(a) - 1; x >= 0; x-- {
+		for y := len(b) - 1; y >= 0; y-- {
+			if a[x] == b[y] {
+				lcs[x][y] = lcs[x+1][y+1] + 1
+			} else if lcs[x+1][y] >= lcs[x][y+1] {
+				lcs[x][y] = lcs[x+1][y]
+			} else {
+				lcs[x][y] = lcs[x][y+1]
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	x, y := 0, 0
+	for x < len(a) || y < len(b) {
+		switch {
+		case x < len(a) && y < len(b) && a[x] == b[y]:
+			fmt.Fprintf(buf, " %s\n", a[x])
+			x++
+			y++
+		case y < len(b) && (x == len(a) || lcs[x][y+1] >= lcs[x+1][y]):
+			fmt.Fprintf(buf, "+%s\n", b[y])
+			y++
+		default:
+			fmt.Fprintf(buf, "-%s\n", a[x])
+			x++
+		}
+	}
+	return buf.String()
+}
+
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
@@ -0,0 +1,258 @@
+package drbd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ReconcileInitialBackoff is the delay before retrying a failed reconcile,
+	// doubled on every consecutive failure up to ReconcileMaxBackoff
+	ReconcileInitialBackoff = 10 * time.Second
+	ReconcileMaxBackoff     = 5 * time.Minute
+)
+
+// Kinds of Drift
+const (
+	DriftFileMissing    = "file_missing"
+	DriftFileMismatch   = "file_mismatch"
+	DriftModNotLoaded   = "mod_not_loaded"
+	DriftLoadedMismatch = "loaded_mismatch"
+	DriftAutoloader     = "autoloader"
+)
+
+// Drift is something found diverged from the installed state on host
+type Drift struct {
+	Kind   string `json:"kind" yaml:"kind"`
+	Detail string `json:"detail" yaml:"detail"`
+}
+
+// ReconcileResult is the outcome of one pass of the reconciler
+type ReconcileResult struct {
+	Time time.Time `json:"time" yaml:"time"`
+	// Drift lists what was found diverged from the installed state, empty if
+	// nothing did
+	Drift []Drift `json:"drift,omitempty" yaml:"drift,omitempty"`
+	// Run is the install run of this pass, or the latest one if nothing had
+	// to be done
+	Run     *RunResult `json:"run,omitempty" yaml:"run,omitempty"`
+	Success bool       `json:"success" yaml:"success"`
+	Error   string     `json:"error,omitempty" yaml:"error,omitempty"`
+	// Ready is true if the DRBD kernel mods of the chosen build are loaded,
+	// NotReadyReason tells why otherwise
+	Ready          bool   `json:"ready" yaml:"ready"`
+	NotReadyReason string `json:"notReadyReason,omitempty" yaml:"notReadyReason,omitempty"`
+	// LoadedDRBDVersion is the version of drbd loaded after the pass
+	LoadedDRBDVersion string `json:"loadedDRBDVersion,omitempty" yaml:"loadedDRBDVersion,omitempty"`
+	// Failures counts the consecutive failed passes
+	Failures int       `json:"failures" yaml:"failures"`
+	NextRun  time.Time `json:"nextRun" yaml:"nextRun"`
+}
+
+// Reconciler periodically verifies the DRBD kernel mods files, loaded mods
+// and autoloader on host, running the install pipeline again when any of
+// them drifted or the previous run failed. Stages with nothing to change
+// are no-ops, so only the drifted or failed ones take effect
+type Reconciler struct {
+	Installer *DRBDKernelModInstaller
+	Interval  time.Duration
+
+	lock      sync.RWMutex
+	last      *ReconcileResult
+	observers []func(*ReconcileResult)
+}
+
+func NewReconciler(installer *DRBDKernelModInstaller, interval time.Duration) *Reconciler {
+	return &Reconciler{Installer: installer, Interval: interval}
+}
+
+// Last returns the result of the last pass, nil before the first one
+func (r *Reconciler) Last() *ReconcileResult {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.last
+}
+
+// AddObserver registers a func called with the result of every pass, e.g. to
+// collect metrics. It must be called before Observe and Run
+func (r *Reconciler) AddObserver(observer func(*ReconcileResult)) {
+	r.observers = append(r.observers, observer)
+}
+
+// Observe records the result of an install run made out of the reconciler,
+// e.g. the initial one
+func (r *Reconciler) Observe(run *RunResult) *ReconcileResult {
+	return r.record(&ReconcileResult{Time: time.Now(), Run: run}, nil)
+}
+
+// Run reconciles until ctx is done, the initial install run should have been
+// observed before. A pass in progress is never interrupted
+func (r *Reconciler) Run(ctx context.Context) {
+	result := r.Last()
+	if result == nil {
+		result = r.reconcile()
+	}
+	for {
+		timer := time.NewTimer(time.Until(result.NextRun))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		result = r.reconcile()
+	}
+}
+
+func (r *Reconciler) reconcile() *ReconcileResult {
+	result := &ReconcileResult{Time: time.Now()}
+	if last := r.Last(); last != nil {
+		result.Run = last.Run
+	}
+
+	drift, err := r.drift()
+	if err != nil {
+		return r.record(result, err)
+	}
+	result.Drift = drift
+
+	lastFailed := result.Run == nil || !result.Run.Success
+	if len(drift) == 0 && !lastFailed {
+		log.Debug("no drift of DRBD kernel mods found on host")
+		return r.record(result, nil)
+	}
+
+	log.WithFields(log.Fields{"drift": drift, "lastFailed": lastFailed}).Info("start reconciling DRBD kernel mods on host")
+	result.Run = r.Installer.Install()
+	if !result.Run.Success {
+		if failed := result.Run.FailedStage(); failed != nil {
+			return r.record(result, fmt.Errorf("stage %s failed: %s", failed.Stage, failed.Error))
+		}
+		return r.record(result, fmt.Errorf("install run not completed"))
+	}
+	return r.record(result, nil)
+}
+
+// drift compares the host with the build chosen for the running kernel
+func (r *Reconciler) drift() ([]Drift, error) {
+	if !r.Installer.HasSuitableDRBDKernelModBuilds() {
+		return nil, ErrNoSuitableBuild
+	}
+	status, err := r.Installer.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	var drift []Drift
+	for _, file := range status.Files {
+		if file.Exists && !file.MatchesCatalog {
+			drift = append(drift, Drift{DriftFileMismatch, fmt.Sprintf("file %s differs from catalog", file.Path)})
+		} else if !file.Exists && r.inBuild(file.Name) {
+			drift = append(drift, Drift{DriftFileMissing, fmt.Sprintf("file %s missing", file.Path)})
+		}
+	}
+	for _, mod := range status.Modules {
+		if !mod.Loaded && r.inBuild(mod.Name) {
+			drift = append(drift, Drift{DriftModNotLoaded, fmt.Sprintf("%s not loaded", mod.Name)})
+		}
+		// an upgrade waiting for reboot is not a drift
+		if mod.Loaded && mod.Name == DRBDModName && !status.LoadedIsInstalled && !r.Installer.UpgradePending {
+			drift = append(drift, Drift{DriftLoadedMismatch, fmt.Sprintf("loaded %s is not the installed one", DRBDModName)})
+		}
+	}
+	// an autoloader modified by hand is kept on purpose
+	modifiedKept := status.Autoloader.Drift == AutoloaderModified && !r.Installer.Config.Force
+	if !status.Autoloader.Current && !modifiedKept {
+		drift = append(drift, Drift{DriftAutoloader, fmt.Sprintf("autoloader %s is %s", status.Autoloader.Path, status.Autoloader.Drift)})
+	}
+	return drift, nil
+}
+
+func (r *Reconciler) inBuild(name string) bool {
+	if r.Installer.Build == nil {
+		return false
+	}
+	for _, module := range r.Installer.Build.Modules {
+		if module.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readiness checks the drbd of the chosen build is loaded. It's called from
+// the goroutine running the installer only, as Status reads its state
+func (r *Reconciler) readiness(result *ReconcileResult) (bool, string) {
+	if r.Installer.Build == nil {
+		return false, ErrNoSuitableBuild.Error()
+	}
+	status, err := r.Installer.Status()
+	if err != nil {
+		return false, err.Error()
+	}
+	for _, mod := range status.Modules {
+		if mod.Name == DRBDModName {
+			result.LoadedDRBDVersion = mod.Version
+		}
+	}
+	for _, mod := range status.Modules {
+		if mod.Name == DRBDModName && !mod.Loaded {
+			return false, fmt.Sprintf("%s not loaded", DRBDModName)
+		}
+		if !mod.Loaded && r.inBuild(mod.Name) {
+			return false, fmt.Sprintf("%s not loaded", mod.Name)
+		}
+	}
+	if !status.LoadedIsInstalled {
+		if r.Installer.UpgradePending {
+			return false, fmt.Sprintf("upgrade to DRBD %s pending until reboot", r.Installer.Build.DRBDVersion)
+		}
+		return false, fmt.Sprintf("loaded %s is not the one of build %s", DRBDModName, r.Installer.Build)
+	}
+	return true, ""
+}
+
+// record keeps result as the last one and schedules the next pass, backing
+// off on consecutive failures
+func (r *Reconciler) record(result *ReconcileResult, err error) *ReconcileResult {
+	result.Ready, result.NotReadyReason = r.readiness(result)
+	defer func() {
+		for _, observer := range r.observers {
+			observer(result)
+		}
+	}()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result.Success = err == nil && result.Run != nil && result.Run.Success
+	if err != nil {
+		result.Error = err.Error()
+	}
+	delay := r.Interval
+	if !result.Success {
+		result.Failures = 1
+		if r.last != nil {
+			result.Failures = r.last.Failures + 1
+		}
+		delay = ReconcileInitialBackoff << uint(result.Failures-1)
+		if delay > ReconcileMaxBackoff || delay <= 0 {
+			delay = ReconcileMaxBackoff
+		}
+		if delay > r.Interval {
+			delay = r.Interval
+		}
+		// a reconciler only observing a single run never retries
+		if r.Interval > 0 {
+			log.WithFields(log.Fields{"failures": result.Failures, "error": result.Error, "retryIn": delay}).Warn("Failed reconciling DRBD kernel mods")
+		}
+	}
+	result.NextRun = result.Time.Add(delay)
+
+	r.last = result
+	return result
+}
@@ -0,0 +1,134 @@
+package drbd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Exit codes of the installer process, derived from the install run by
+// ExitCode
+const (
+	// ExitSuccess means all stages succeeded
+	ExitSuccess = 0
+	// ExitError is any other error, e.g. the installer failed to start
+	ExitError = 1
+	// ExitUsage is an unknown command or flag
+	ExitUsage = 2
+	// ExitNoSuitableBuild means no build in the catalog fits the host kernel
+	ExitNoSuitableBuild = 3
+	// ExitCopyFailed means the mods were refused by the symbol CRCs check or
+	// validation, or failed to be copied to host
+	ExitCopyFailed = 4
+	// ExitDepmodFailed means the depmod.d override or depmod failed
+	ExitDepmodFailed = 5
+	// ExitModprobeFailed means the mods parameters or loading the mods failed
+	ExitModprobeFailed = 6
+	// ExitAutoloadFailed means making the mods load on boot, for the running
+	// or other installed kernels, failed
+	ExitAutoloadFailed = 7
+	// ExitPartialSuccess means some stages failed but were skipped with
+	// Config.SkipError
+	ExitPartialSuccess = 8
+)
+
+const (
+	// DefaultReportPath is where Kubernetes reads the termination message of
+	// a container from, so the report shows up in the pod status
+	DefaultReportPath = "/dev/termination-log"
+	// TerminationLogMaxSize is the size Kubernetes truncates the termination
+	// message to
+	TerminationLogMaxSize = 4096
+)
+
+var exitReasons = map[int]string{
+	ExitSuccess:         "Success",
+	ExitError:           "Error",
+	ExitUsage:           "Usage",
+	ExitNoSuitableBuild: "NoSuitableBuild",
+	ExitCopyFailed:      "CopyFailed",
+	ExitDepmodFailed:    "DepmodFailed",
+	ExitModprobeFailed:  "ModprobeFailed",
+	ExitAutoloadFailed:  "AutoloadFailed",
+	ExitPartialSuccess:  "PartialSuccess",
+}
+
+var stageExitCodes = map[string]int{
+	StageFindBuild:         ExitNoSuitableBuild,
+	StageCheckSymbolCRCs:   ExitCopyFailed,
+	StageCheckDepends:      ExitCopyFailed,
+	StageCopy:              ExitCopyFailed,
+	StageDepmodOverride:    ExitDepmodFailed,
+	StageDepmod:            ExitDepmodFailed,
+	StageModprobeConf:      ExitModprobeFailed,
+	StageModprobe:          ExitModprobeFailed,
+	StageApplyModuleParams: ExitModprobeFailed,
+	StageInstalledKernels:  ExitAutoloadFailed,
+	StageKernelHook:        ExitAutoloadFailed,
+	StageAutoload:          ExitAutoloadFailed,
+}
+
+// ExitCode returns the exit code of the process for the run
+func (r *RunResult) ExitCode() int {
+	if r.Success {
+		return ExitSuccess
+	}
+	if r.Completed {
+		return ExitPartialSuccess
+	}
+	if failed := r.FailedStage(); failed != nil {
+		if code, exists := stageExitCodes[failed.Stage]; exists {
+			return code
+		}
+	}
+	return ExitError
+}
+
+// Report is the machine-readable outcome of the installer process
+type Report struct {
+	ExitCode int    `json:"exitCode"`
+	Reason   string `json:"reason"`
+	Error    string `json:"error,omitempty"`
+	// Run is the last install run, nil if the installer failed to start
+	Run *RunResult `json:"run,omitempty"`
+}
+
+// NewReport reports the run, or err if the installer failed before running
+func NewReport(run *RunResult, err error) *Report {
+	report := &Report{ExitCode: ExitError, Run: run}
+	if run != nil {
+		report.ExitCode = run.ExitCode()
+		if failed := run.FailedStage(); failed != nil {
+			report.Error = failed.Error
+		}
+	}
+	if err != nil {
+		report.ExitCode = ExitError
+		report.Error = err.Error()
+	}
+	report.Reason = exitReasons[report.ExitCode]
+	return report
+}
+
+// Write writes the report as JSON to path. A report larger than what
+// Kubernetes keeps of a termination message is stripped of the file details
+func (r *Report) Write(path string) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if len(data) > TerminationLogMaxSize && r.Run != nil {
+		run := *r.Run
+		run.Files, run.KernelHooks = nil, nil
+		run.InstalledKernels = nil
+		for _, kernel := range r.Run.InstalledKernels {
+			kernel.Files = nil
+			run.InstalledKernels = append(run.InstalledKernels, kernel)
+		}
+		stripped := *r
+		stripped.Run = &run
+		if data, err = json.Marshal(&stripped); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
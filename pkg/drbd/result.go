@@ -0,0 +1,101 @@
+package drbd
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNoSuitableBuild is reported when no DRBD kernel mods build fits the host
+var ErrNoSuitableBuild = errors.New("No Suitable DRBD kernel mods")
+
+// RunResult is the outcome of one run of the install pipeline
+type RunResult struct {
+	StartTime   time.Time     `json:"startTime" yaml:"startTime"`
+	EndTime     time.Time     `json:"endTime" yaml:"endTime"`
+	Kernel      string        `json:"kernel" yaml:"kernel"`
+	Build       string        `json:"build,omitempty" yaml:"build,omitempty"`
+	DRBDVersion string        `json:"drbdVersion,omitempty" yaml:"drbdVersion,omitempty"`
+	BuildDigest string        `json:"buildDigest,omitempty" yaml:"buildDigest,omitempty"`
+	Stages      []StageResult `json:"stages" yaml:"stages"`
+	// Files are the results of the kernel mod files written to host
+	Files []FileResult `json:"files,omitempty" yaml:"files,omitempty"`
+	// DepmodConf is the result of writing the depmod.d override to host
+	DepmodConf *FileResult `json:"depmodConf,omitempty" yaml:"depmodConf,omitempty"`
+	// ModprobeConf is the result of writing the mods parameters to host,
+	// ParamChanges the parameters differing on the loaded mods
+	ModprobeConf *FileResult   `json:"modprobeConf,omitempty" yaml:"modprobeConf,omitempty"`
+	ParamChanges []ParamChange `json:"paramChanges,omitempty" yaml:"paramChanges,omitempty"`
+	// Autoloader is the result of ensuring the mods load on boot
+	Autoloader *AutoloaderResult `json:"autoloader,omitempty" yaml:"autoloader,omitempty"`
+	// InstalledKernels are the results of staging mods for the kernels
+	// installed on host other than the running one
+	InstalledKernels []KernelStageResult `json:"installedKernels,omitempty" yaml:"installedKernels,omitempty"`
+	// KernelHooks are the results of the kernel hooks written to host
+	KernelHooks []FileResult `json:"kernelHooks,omitempty" yaml:"kernelHooks,omitempty"`
+	// UpgradePending is true if a new drbd waits for next reboot to be loaded
+	UpgradePending bool            `json:"upgradePending" yaml:"upgradePending"`
+	Rollback       *RollbackResult `json:"rollback,omitempty" yaml:"rollback,omitempty"`
+	// Completed is true if the pipeline ran to its end, maybe skipping
+	// failed stages, Success only if no stage failed
+	Completed bool `json:"completed" yaml:"completed"`
+	Success   bool `json:"success" yaml:"success"`
+}
+
+// StageResult is the outcome of a single stage of the install pipeline
+type StageResult struct {
+	Stage   string `json:"stage" yaml:"stage"`
+	Success bool   `json:"success" yaml:"success"`
+	Error   string `json:"error,omitempty" yaml:"error,omitempty"`
+	// Stderr is the stderr of the host command the stage failed on, if any
+	Stderr   string        `json:"stderr,omitempty" yaml:"stderr,omitempty"`
+	Duration time.Duration `json:"duration" yaml:"duration"`
+
+	err error
+}
+
+// KernelStageResult is the outcome of staging DRBD kernel mods for a kernel
+// installed on host, Error is set if the host would boot into it without DRBD
+type KernelStageResult struct {
+	Kernel      string       `json:"kernel" yaml:"kernel"`
+	Build       string       `json:"build,omitempty" yaml:"build,omitempty"`
+	DRBDVersion string       `json:"drbdVersion,omitempty" yaml:"drbdVersion,omitempty"`
+	Files       []FileResult `json:"files,omitempty" yaml:"files,omitempty"`
+	Error       string       `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// RollbackResult is the outcome of reverting host changes of a failed run
+type RollbackResult struct {
+	// Restored are the files put back from backup, Removed the ones created
+	// by the failed run
+	Restored []string `json:"restored,omitempty" yaml:"restored,omitempty"`
+	Removed  []string `json:"removed,omitempty" yaml:"removed,omitempty"`
+	// Reloaded are the previously loaded mods loaded again
+	Reloaded []string `json:"reloaded,omitempty" yaml:"reloaded,omitempty"`
+	Success  bool     `json:"success" yaml:"success"`
+	Error    string   `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Err returns the error of the stage, nil if it succeeded
+func (s *StageResult) Err() error {
+	return s.err
+}
+
+// FailedStage returns the first failed stage, nil if all succeeded
+func (r *RunResult) FailedStage() *StageResult {
+	for idx := range r.Stages {
+		if !r.Stages[idx].Success {
+			return &r.Stages[idx]
+		}
+	}
+	return nil
+}
+
+// Stage returns the result of stage, nil if it didn't run
+func (r *RunResult) Stage(stage string) *StageResult {
+	for idx := range r.Stages {
+		if r.Stages[idx].Stage == stage {
+			return &r.Stages[idx]
+		}
+	}
+	return nil
+}
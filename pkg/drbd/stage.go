@@ -0,0 +1,69 @@
+package drbd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Stages of the install pipeline, named after the installer methods
+const (
+	StageNewInstaller      = "NewDRBDKernelModInstaller"
+	StageFindBuild         = "HasSuitableDRBDKernelModBuilds"
+	StageCheckSymbolCRCs   = "CheckSymbolCRCs"
+	StageCheckDepends      = "CheckExternalDepends"
+	StageCopy              = "CopyKernelModToHost"
+	StageDepmodOverride    = "EnsureDepmodOverride"
+	StageDepmod            = "Depmod"
+	StageModprobeConf      = "EnsureModprobeConf"
+	StageModprobe          = "Modprobe"
+	StageApplyModuleParams = "ApplyModuleParams"
+	StageAutoload          = "EnsureAutoLoadWhenHostRestarted"
+	StageInstalledKernels  = "StageInstalledKernels"
+	StageKernelHook        = "InstallKernelHook"
+	StageUninstall         = "Uninstall"
+	StageRollback          = "Rollback"
+)
+
+// Phases of a StageEvent
+const (
+	StageStarted   = "Started"
+	StageSucceeded = "Succeeded"
+	StageFailed    = "Failed"
+)
+
+// StageEvent tells a stage of the install pipeline started or ended, it's
+// passed to the funcs registered with AddStageObserver
+type StageEvent struct {
+	Stage       string
+	Description string
+	Phase       string
+	// Error includes the stderr of the host command the stage failed on
+	Error    string
+	Duration time.Duration
+}
+
+// CommandError is returned when a command run on host exits with an error
+type CommandError struct {
+	Command []string
+	Err     error
+	Stderr  string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s(%s)", e.Err, e.Stderr)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// commandStderr returns the stderr of the host command err comes from
+func commandStderr(err error) string {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		return strings.TrimSpace(cmdErr.Stderr)
+	}
+	return ""
+}
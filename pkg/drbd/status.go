@@ -0,0 +1,108 @@
+package drbd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DRBDModName            = "drbd"
+	DRBDTransportModPrefix = "drbd_transport_"
+
+	StatusFormatText = "text"
+	StatusFormatJSON = "json"
+	StatusFormatYAML = "yaml"
+)
+
+// Status is the DRBD installation state of the node
+type Status struct {
+	Kernel       string            `json:"kernel" yaml:"kernel"`
+	Arch         string            `json:"arch" yaml:"arch"`
+	MatchedBuild *BuildStatus      `json:"matchedBuild,omitempty" yaml:"matchedBuild,omitempty"`
+	Files        []KernelModFile   `json:"files" yaml:"files"`
+	Modules      []LoadedModStatus `json:"modules" yaml:"modules"`
+	Autoloader   AutoloaderStatus  `json:"autoloader" yaml:"autoloader"`
+	// LoadedIsInstalled is true if the loaded drbd is the one in the host
+	// kernel mods path
+	LoadedIsInstalled bool `json:"loadedIsInstalled" yaml:"loadedIsInstalled"`
+}
+
+// BuildStatus is the DRBD kernel mods build matched for the host kernel
+type BuildStatus struct {
+	Kernel      string `json:"kernel" yaml:"kernel"`
+	Arch        string `json:"arch" yaml:"arch"`
+	DRBDVersion string `json:"drbdVersion" yaml:"drbdVersion"`
+	Dir         string `json:"dir" yaml:"dir"`
+}
+
+// KernelModFile is a DRBD kernel mod file on the host
+type KernelModFile struct {
+	Name   string `json:"name" yaml:"name"`
+	Path   string `json:"path" yaml:"path"`
+	Exists bool   `json:"exists" yaml:"exists"`
+	SHA256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	// MatchesCatalog is true if the digest equals the one in the catalog
+	MatchesCatalog bool   `json:"matchesCatalog" yaml:"matchesCatalog"`
+	SrcVersion     string `json:"srcversion,omitempty" yaml:"srcversion,omitempty"`
+}
+
+// LoadedModStatus is the state of a DRBD kernel mod in the running kernel
+type LoadedModStatus struct {
+	Name       string `json:"name" yaml:"name"`
+	Loaded     bool   `json:"loaded" yaml:"loaded"`
+	Version    string `json:"version,omitempty" yaml:"version,omitempty"`
+	SrcVersion string `json:"srcversion,omitempty" yaml:"srcversion,omitempty"`
+	RefCount   int    `json:"refcnt" yaml:"refcnt"`
+}
+
+// AutoloaderStatus is the state of the file loading DRBD kernel mods on boot
+type AutoloaderStatus struct {
+	Backend string `json:"backend" yaml:"backend"`
+	Path    string `json:"path" yaml:"path"`
+	Present bool   `json:"present" yaml:"present"`
+	// Current is true if the content is what the installer would generate,
+	// Drift tells how it differs otherwise
+	Current bool   `json:"current" yaml:"current"`
+	Drift   string `json:"drift,omitempty" yaml:"drift,omitempty"`
+}
+
+// Format renders the status as text, json or yaml
+func (s *Status) Format(format string) ([]byte, error) {
+	switch format {
+	case StatusFormatJSON:
+		return json.MarshalIndent(s, "", "  ")
+	case StatusFormatYAML:
+		return yaml.Marshal(s)
+	case StatusFormatText, "":
+		return s.text(), nil
+	}
+	return nil, fmt.Errorf("unknown status format %q", format)
+}
+
+func (s *Status) text() []byte {
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Kernel:\t%s\n", s.Kernel)
+	fmt.Fprintf(w, "Arch:\t%s\n", s.Arch)
+	if s.MatchedBuild != nil {
+		fmt.Fprintf(w, "Matched build:\t%s/%s (DRBD %s)\n", s.MatchedBuild.Kernel, s.MatchedBuild.Arch, s.MatchedBuild.DRBDVersion)
+	} else {
+		fmt.Fprintf(w, "Matched build:\t<none>\n")
+	}
+	for _, file := range s.Files {
+		fmt.Fprintf(w, "File %s:\t%s exists=%t matchesCatalog=%t srcversion=%s\n", file.Name, file.Path, file.Exists, file.MatchesCatalog, file.SrcVersion)
+	}
+	for _, mod := range s.Modules {
+		fmt.Fprintf(w, "Module %s:\tloaded=%t version=%s srcversion=%s refcnt=%d\n", mod.Name, mod.Loaded, mod.Version, mod.SrcVersion, mod.RefCount)
+	}
+	fmt.Fprintf(w, "Autoloader:\t%s %s present=%t current=%t drift=%s\n", s.Autoloader.Backend, s.Autoloader.Path, s.Autoloader.Present, s.Autoloader.Current, s.Autoloader.Drift)
+	fmt.Fprintf(w, "Loaded is installed:\t%t\n", s.LoadedIsInstalled)
+
+	w.Flush()
+	return buf.Bytes()
+}
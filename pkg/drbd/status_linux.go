@@ -0,0 +1,126 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hwameistor/drbd-installer/pkg/catalog"
+	"github.com/hwameistor/drbd-installer/pkg/kmod"
+)
+
+// DRBDTransportTCPModName is the transport loaded along with drbd by default
+const DRBDTransportTCPModName = DRBDTransportModPrefix + "tcp"
+
+// Status reports the DRBD installation state of the node without changing
+// anything. HasSuitableDRBDKernelModBuilds should be called before to report
+// the matched build and compare files with the catalog
+func (i *DRBDKernelModInstaller) Status() (*Status, error) {
+	status := &Status{
+		Kernel:     i.Kernel.Original,
+		Arch:       i.Arch,
+		Autoloader: AutoloaderStatus{Backend: i.Autoloader.Name(), Path: i.Autoloader.Path()},
+	}
+
+	expected := map[string]string{}
+	if i.Build != nil {
+		status.MatchedBuild = &BuildStatus{
+			Kernel:      i.Build.Kernel,
+			Arch:        i.Build.Arch,
+			DRBDVersion: i.Build.DRBDVersion,
+			Dir:         i.Build.Path,
+		}
+		for _, module := range i.Build.Modules {
+			expected[module.Name] = module.SHA256
+		}
+	}
+
+	names, err := i.statusModNames()
+	if err != nil {
+		return nil, err
+	}
+	installedSrcVersion := ""
+	for _, name := range names {
+		file := KernelModFile{
+			Name: name,
+			Path: filepath.Join(i.KernelModToHostPath, name+catalog.KernelModExt),
+		}
+		if file.Exists, err = isFileExists(file.Path); err != nil {
+			return nil, err
+		}
+		if file.Exists {
+			if file.SHA256, err = catalog.FileSHA256(file.Path); err != nil {
+				return nil, err
+			}
+			file.MatchesCatalog = expected[name] != "" && expected[name] == file.SHA256
+			if info, err := kmod.ReadModInfo(file.Path); err == nil {
+				file.SrcVersion = info.SrcVersion
+			}
+			if name == DRBDModName {
+				installedSrcVersion = file.SrcVersion
+			}
+		}
+		status.Files = append(status.Files, file)
+
+		mod := LoadedModStatus{Name: name}
+		if mod.Loaded, err = isFileExists(filepath.Join(SysModulePath, name)); err != nil {
+			return nil, err
+		}
+		if mod.Loaded {
+			mod.Version, _ = readSysModuleAttr(name, "version")
+			mod.SrcVersion, _ = readSysModuleAttr(name, "srcversion")
+			mod.RefCount, _ = readSysModuleRefCount(name)
+			if name == DRBDModName {
+				status.LoadedIsInstalled = installedSrcVersion != "" && mod.SrcVersion == installedSrcVersion
+			}
+		}
+		status.Modules = append(status.Modules, mod)
+	}
+
+	content, present, err := readFileIfExists(i.Autoloader.Path())
+	if err != nil {
+		return nil, err
+	}
+	status.Autoloader.Present = present
+	if mods, err := i.installedModNames(); err == nil {
+		status.Autoloader.Drift = autoloaderDrift(i.Autoloader, content, present, i.Autoloader.Render(content, mods))
+		status.Autoloader.Current = status.Autoloader.Drift == AutoloaderCurrent
+	}
+
+	return status, nil
+}
+
+// statusModNames lists the mods of the matched build, or the ones found on
+// host if there is none, always including drbd and drbd_transport_tcp
+func (i *DRBDKernelModInstaller) statusModNames() ([]string, error) {
+	names := []string{DRBDModName, DRBDTransportTCPModName}
+	seen := map[string]bool{DRBDModName: true, DRBDTransportTCPModName: true}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	if i.Build != nil {
+		for _, module := range i.Build.Modules {
+			add(module.Name)
+		}
+		return names, nil
+	}
+
+	files, err := ioutil.ReadDir(i.KernelModToHostPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == catalog.KernelModExt {
+			add(strings.TrimSuffix(file.Name(), catalog.KernelModExt))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,233 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hwameistor/drbd-installer/pkg/exechelper"
+	log "github.com/sirupsen/logrus"
+)
+
+// BackupDirName is the dir in Config.StateDir holding the files replaced by
+// the running install, one sub dir per run
+const BackupDirName = "backup"
+
+// transaction records the host changes of an install run so they can be
+// reverted if a later stage fails
+type transaction struct {
+	dir     string
+	entries []*backupEntry
+	tracked map[string]bool
+	// loadedMods are the DRBD mods loaded before the run
+	loadedMods []string
+	// modsChanged is true once the run unloaded or loaded any mod
+	modsChanged bool
+}
+
+type backupEntry struct {
+	path       string
+	backupPath string
+	existed    bool
+}
+
+func (i *DRBDKernelModInstaller) beginTransaction() error {
+	tx := &transaction{
+		dir:     filepath.Join(i.Config.StateDir, BackupDirName, strconv.FormatInt(time.Now().Unix(), 10)),
+		tracked: map[string]bool{},
+	}
+	if err := os.MkdirAll(tx.dir, 0700); err != nil {
+		return err
+	}
+
+	loaded, err := readLoadedModules()
+	if err != nil {
+		return err
+	}
+	for name := range loaded {
+		if name == DRBDModName || strings.HasPrefix(name, DRBDTransportModPrefix) {
+			tx.loadedMods = append(tx.loadedMods, name)
+		}
+	}
+	// drbd sorts before its transports, which is the load order
+	sort.Strings(tx.loadedMods)
+
+	i.tx = tx
+	return nil
+}
+
+// trackHostFile backs up path before it's replaced, or remembers it didn't
+// exist. It does nothing out of a transaction or if path is already tracked
+func (i *DRBDKernelModInstaller) trackHostFile(path string) error {
+	if i.tx == nil || i.tx.tracked[path] {
+		return nil
+	}
+
+	entry := &backupEntry{path: path, backupPath: filepath.Join(i.tx.dir, path)}
+	exists, err := isFileExists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := copyFilePreservingMode(path, entry.backupPath); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+		entry.existed = true
+	}
+	i.tx.entries = append(i.tx.entries, entry)
+	i.tx.tracked[path] = true
+	return nil
+}
+
+// commitTransaction drops the backups of a successful run
+func (i *DRBDKernelModInstaller) commitTransaction() {
+	if i.tx == nil {
+		return
+	}
+	if err := os.RemoveAll(i.tx.dir); err != nil {
+		log.WithError(err).Warnf("Failed to remove backup dir %s", i.tx.dir)
+	}
+	i.tx = nil
+}
+
+// rollback reverts the host changes of the running transaction: unloads the
+// new mods, restores the replaced files, regenerates dependencies of every
+// kernel it touched and loads the previously loaded mods again
+func (i *DRBDKernelModInstaller) rollback() *RollbackResult {
+	result := &RollbackResult{}
+	if i.tx == nil {
+		result.Success = true
+		return result
+	}
+	tx := i.tx
+	i.tx = nil
+
+	var errs []string
+	if tx.modsChanged {
+		if err := i.unloadKernelMods(StageRollback); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for idx := len(tx.entries) - 1; idx >= 0; idx-- {
+		entry := tx.entries[idx]
+		if entry.existed {
+			if err := copyFilePreservingMode(entry.backupPath, entry.path); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to restore %s: %s", entry.path, err))
+				continue
+			}
+			result.Restored = append(result.Restored, entry.path)
+		} else {
+			if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, fmt.Sprintf("failed to remove %s: %s", entry.path, err))
+				continue
+			}
+			result.Removed = append(result.Removed, entry.path)
+		}
+	}
+
+	if len(tx.entries) > 0 {
+		if err := i.runHostCommand(StageRollback, exechelper.ExecParams{CmdName: DepmodCMD, Timeout: 300}); err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, kernel := range tx.otherKernels(i.Kernel.Original) {
+			if err := i.runHostCommand(StageRollback, exechelper.ExecParams{
+				CmdName: DepmodCMD,
+				CmdArgs: []string{kernel},
+				Timeout: 300,
+			}); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if tx.modsChanged {
+		reloaded, err := i.reloadKernelMods(tx.loadedMods)
+		result.Reloaded = reloaded
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	result.Success = len(errs) == 0
+	result.Error = strings.Join(errs, "; ")
+	if result.Success {
+		// the backups are only kept for manual recovery
+		os.RemoveAll(tx.dir)
+	}
+	return result
+}
+
+// otherKernels lists the kernels besides running whose mods dir in
+// LibModulesDir holds a file of the transaction
+func (tx *transaction) otherKernels(running string) []string {
+	seen := map[string]bool{}
+	var kernels []string
+	for _, entry := range tx.entries {
+		rel, err := filepath.Rel(LibModulesDir, entry.path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		kernel := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+		if kernel == running || seen[kernel] {
+			continue
+		}
+		seen[kernel] = true
+		kernels = append(kernels, kernel)
+	}
+	sort.Strings(kernels)
+	return kernels
+}
+
+// reloadKernelMods loads the mods in names which are not loaded
+func (i *DRBDKernelModInstaller) reloadKernelMods(names []string) ([]string, error) {
+	loaded, err := readLoadedModules()
+	if err != nil {
+		return nil, err
+	}
+
+	var reloaded []string
+	for _, name := range names {
+		if _, exists := loaded[name]; exists {
+			continue
+		}
+		if err := i.runHostCommand(StageRollback, exechelper.ExecParams{CmdName: ModprobeCMD, CmdArgs: []string{name}}); err != nil {
+			return reloaded, err
+		}
+		reloaded = append(reloaded, name)
+	}
+	return reloaded, nil
+}
+
+// markModsChanged records the run is about to unload or load mods, so a
+// rollback has to restore the previously loaded ones
+func (i *DRBDKernelModInstaller) markModsChanged() {
+	if i.tx != nil {
+		i.tx.modsChanged = true
+	}
+}
+
+func copyFilePreservingMode(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	return writeFileAtomic(dst, source, info.Mode().Perm())
+}
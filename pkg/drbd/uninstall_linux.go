@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hwameistor/drbd-installer/pkg/exechelper"
+	"github.com/hwameistor/drbd-installer/pkg/kmod"
+	log "github.com/sirupsen/logrus"
+)
+
+const RmmodCMD = "rmmod"
+
+// Uninstall reverses what CopyKernelModToHost, StageInstalledKernels,
+// Modprobe and EnsureAutoLoadWhenHostRestarted did: unloads DRBD kernel mods,
+// removes their files of all kernels, the kernel hooks, the autoloader and
+// the modprobe.d and depmod.d files from host and regenerates dependencies
+func (i *DRBDKernelModInstaller) Uninstall() error {
+	log.Info("start unloading DRBD kernel mods from host")
+	if err := i.UnloadKernelMods(); err != nil {
+		return err
+	}
+
+	log.Infof("start removing DRBD kernel mods in %s", i.KernelModToHostPath)
+	if err := i.removeHostFile(i.KernelModToHostPath); err != nil {
+		return err
+	}
+	log.Infof("%s has being successfully removed from host", i.KernelModToHostPath)
+
+	if err := i.removeInstalledKernelsMods(); err != nil {
+		return err
+	}
+	if err := i.removeKernelHook(); err != nil {
+		return err
+	}
+
+	log.Infof("start removing DRBD kernel mods autoloader %s", i.Autoloader.Path())
+	if err := i.removeAutoloader(); err != nil {
+		return err
+	}
+	log.Infof("%s has being successfully removed from host", i.Autoloader.Path())
+
+	for _, path := range []string{i.modprobeConfPath(), i.depmodConfPath()} {
+		if err := i.removeManagedHostFile(path); err != nil {
+			return err
+		}
+	}
+
+	log.Info("start regenerating kernel mods dependencies")
+	if err := i.Depmod(); err != nil {
+		return err
+	}
+	log.Info("kernel mods dependencies have being successfully regenerated")
+	return nil
+}
+
+// UnloadKernelMods unloads drbd_transport_* mods and then drbd, refusing to
+// do so if any of them is still in use, e.g. by a DRBD resource
+func (i *DRBDKernelModInstaller) UnloadKernelMods() error {
+	return i.unloadKernelMods(StageUninstall)
+}
+
+func (i *DRBDKernelModInstaller) unloadKernelMods(stage string) error {
+	loaded, err := readLoadedModules()
+	if err != nil {
+		return err
+	}
+	names, err := unloadOrder(loaded)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := i.runHostCommand(stage, exechelper.ExecParams{
+			CmdName: RmmodCMD,
+			CmdArgs: []string{name},
+		}); err != nil {
+			return err
+		}
+		log.Infof("%s has being successfully unloaded from host", name)
+	}
+	return nil
+}
+
+// unloadOrder returns the loaded drbd_transport_* mods followed by drbd, the
+// order to unload them in. It fails if any of them is in use, before anything
+// is unloaded, so the host is never left with drbd but without its transports
+func unloadOrder(loaded map[string]*kmod.LoadedModule) ([]string, error) {
+	var transports []string
+	for name := range loaded {
+		if strings.HasPrefix(name, DRBDTransportModPrefix) {
+			transports = append(transports, name)
+		}
+	}
+	sort.Strings(transports)
+
+	var names []string
+	for _, name := range append(transports, DRBDModName) {
+		// refcnt of drbd counts the loaded transports as well
+		module, exists := loaded[name]
+		if !exists {
+			log.Infof("%s is not loaded", name)
+			continue
+		}
+		if refCount := module.RefCount - countLoaded(module.UsedBy, transports); refCount > 0 {
+			return nil, fmt.Errorf("%s is in use (refcnt %d, used by %v), refuse to unload", name, module.RefCount, module.UsedBy)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// removeHostFile removes path recursively, or only records it in dry-run mode
+func (i *DRBDKernelModInstaller) removeHostFile(path string) error {
+	if i.Plan != nil {
+		if exists, err := isFileExists(path); err != nil || !exists {
+			return err
+		}
+		i.Plan.add(PlanAction{Stage: StageUninstall, Kind: PlanRemoveFile, Path: path})
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+func readLoadedModules() (map[string]*kmod.LoadedModule, error) {
+	file, err := os.Open(kmod.ProcModulesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return kmod.ParseProcModules(file)
+}
+
+func countLoaded(users, unloaded []string) int {
+	count := 0
+	for _, user := range users {
+		for _, name := range unloaded {
+			if user == name {
+				count++
+			}
+		}
+	}
+	return count
+}
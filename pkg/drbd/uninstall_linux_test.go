@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hwameistor/drbd-installer/pkg/kmod"
+)
+
+func TestUnloadOrder(t *testing.T) {
+	loaded, err := kmod.ParseProcModules(strings.NewReader(
+		"drbd_transport_tcp 28672 0 - Live 0x0000000000000000 (OE)\n" +
+			"drbd 568497 1 drbd_transport_tcp, Live 0x0000000000000000 (OE)\n" +
+			"libcrc32c 16384 1 drbd, Live 0x0000000000000000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := unloadOrder(loaded)
+	if err != nil {
+		t.Fatalf("unloadOrder() error = %v", err)
+	}
+	if want := []string{"drbd_transport_tcp", "drbd"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("unloadOrder() = %v, want %v", names, want)
+	}
+}
+
+func TestUnloadOrderDRBDInUse(t *testing.T) {
+	// the transport is unused but a DRBD resource holds drbd
+	loaded, err := kmod.ParseProcModules(strings.NewReader(
+		"drbd_transport_tcp 28672 0 - Live 0x0000000000000000 (OE)\n" +
+			"drbd 568497 2 drbd_transport_tcp, Live 0x0000000000000000 (OE)\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, err := unloadOrder(loaded); err == nil {
+		t.Errorf("unloadOrder() = %v, want in use error", names)
+	}
+}
@@ -0,0 +1,163 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SysModulePath = "/sys/module"
+	ProcDRBDPath  = "/proc/drbd"
+)
+
+// LoadedDRBD describes the drbd kernel mod loaded in the running kernel
+type LoadedDRBD struct {
+	Version    string
+	SrcVersion string
+	RefCount   int
+	// Holders are the mods depending on drbd, e.g. drbd_transport_tcp
+	Holders []string
+	// InUse is true if any DRBD resource still references drbd or one of
+	// its transports
+	InUse bool
+}
+
+// ReadLoadedDRBD returns the loaded drbd kernel mod, nil if it's not loaded
+func ReadLoadedDRBD() (*LoadedDRBD, error) {
+	modPath := filepath.Join(SysModulePath, DRBDModName)
+	if exists, err := isFileExists(modPath); err != nil || !exists {
+		return nil, err
+	}
+
+	loaded := &LoadedDRBD{}
+	loaded.Version, _ = readSysModuleAttr(DRBDModName, "version")
+	if loaded.Version == "" {
+		version, err := readProcDRBDVersion()
+		if err != nil {
+			return nil, err
+		}
+		loaded.Version = version
+	}
+	loaded.SrcVersion, _ = readSysModuleAttr(DRBDModName, "srcversion")
+
+	refCount, err := readSysModuleRefCount(DRBDModName)
+	if err != nil {
+		return nil, err
+	}
+	loaded.RefCount = refCount
+
+	holders, err := ioutil.ReadDir(filepath.Join(modPath, "holders"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, holder := range holders {
+		loaded.Holders = append(loaded.Holders, holder.Name())
+		holderRefCount, err := readSysModuleRefCount(holder.Name())
+		if err != nil {
+			return nil, err
+		}
+		if holderRefCount > 0 {
+			loaded.InUse = true
+		}
+	}
+	// each holder takes a reference, anything beyond is a DRBD resource
+	if loaded.RefCount > len(loaded.Holders) {
+		loaded.InUse = true
+	}
+	return loaded, nil
+}
+
+// prepareUpgrade checks whether the loaded drbd differs from the chosen build,
+// by version or srcversion, e.g. an in-tree drbd 8.4, and unloads it if it's
+// not in use, so Modprobe loads the new one. It returns false if the loaded
+// drbd is in use and the upgrade has to wait for the next reboot, in which
+// case nothing should be loaded now
+func (i *DRBDKernelModInstaller) prepareUpgrade() (bool, error) {
+	loaded, err := ReadLoadedDRBD()
+	if err != nil {
+		return false, err
+	}
+	if loaded == nil {
+		return true, nil
+	}
+
+	i.LoadedDRBDVersion = loaded.Version
+	if i.Build == nil || i.Build.DRBDVersion == "" {
+		return true, nil
+	}
+	// the same version may be built elsewhere, e.g. by the distro
+	buildSrcVersion := i.buildSrcVersion(DRBDModName)
+	if loaded.Version == i.Build.DRBDVersion && (buildSrcVersion == "" || loaded.SrcVersion == buildSrcVersion) {
+		return true, nil
+	}
+
+	logCtx := log.WithFields(log.Fields{"loaded": loaded.Version, "build": i.Build.DRBDVersion, "srcversion": loaded.SrcVersion})
+	if strings.HasPrefix(loaded.Version, "8.") {
+		logCtx.Warn("in-tree DRBD 8.x kernel mod is loaded")
+	}
+	if loaded.InUse {
+		i.UpgradePending = true
+		logCtx.WithFields(log.Fields{"refcnt": loaded.RefCount, "holders": loaded.Holders}).
+			Warn("upgrade pending, module in use. New DRBD kernel mods will be loaded after next reboot")
+		return false, nil
+	}
+
+	logCtx.Info("upgrading loaded DRBD kernel mods")
+	i.markModsChanged()
+	if err := i.unloadKernelMods(StageModprobe); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func readSysModuleAttr(modName, attr string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(SysModulePath, modName, attr))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readSysModuleRefCount(modName string) (int, error) {
+	refCount, err := readSysModuleAttr(modName, "refcnt")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(refCount)
+}
+
+// readProcDRBDVersion parses the first line of /proc/drbd, which looks like
+// "version: 9.0.22-2 (api:2/proto:86-117)"
+func readProcDRBDVersion() (string, error) {
+	file, err := os.Open(ProcDRBDPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "version:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "version:"))
+		if len(fields) > 0 {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no version found in %s", ProcDRBDPath)
+}
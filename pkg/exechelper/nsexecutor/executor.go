@@ -34,19 +34,29 @@ func New() exechelper.Executor {
 // RunCommand runs a command to completion, and get returns
 // If env variable CMD_NSENTER_RUN_ARGS is set, value will set to esenter arg list by default.
 func (e *nsenterExecutor) RunCommand(params exechelper.ExecParams) exechelper.ExecResult {
-	command := append([]string{params.CmdName}, params.CmdArgs...)
-	combinedArgs := append(e.nsenterArgs, command...)
-	params.CmdName = nsenterCommand
-	params.CmdArgs = combinedArgs
-	return e.pExecutor.RunCommand(params)
+	return e.pExecutor.RunCommand(e.wrap(params))
 }
 
 func (e *nsenterExecutor) RunDaemonCommand(ctx context.Context, params exechelper.ExecParams) *exechelper.ExecDaemonResult {
-	command := append([]string{params.CmdName}, params.CmdArgs...)
-	combinedArgs := append(e.nsenterArgs, command...)
+	return e.pExecutor.RunDaemonCommand(ctx, e.wrap(params))
+}
+
+// CommandLine returns the full nsenter command line RunCommand would run for params
+func CommandLine(params exechelper.ExecParams) []string {
+	nsenter := New().(*nsenterExecutor)
+	wrapped := nsenter.wrap(params)
+	return append([]string{wrapped.CmdName}, wrapped.CmdArgs...)
+}
+
+// wrap turns params into the nsenter command running it in target namespaces
+func (e *nsenterExecutor) wrap(params exechelper.ExecParams) exechelper.ExecParams {
+	combinedArgs := make([]string, 0, len(e.nsenterArgs)+len(params.CmdArgs)+1)
+	combinedArgs = append(combinedArgs, e.nsenterArgs...)
+	combinedArgs = append(combinedArgs, params.CmdName)
+	combinedArgs = append(combinedArgs, params.CmdArgs...)
 	params.CmdName = nsenterCommand
 	params.CmdArgs = combinedArgs
-	return e.pExecutor.RunDaemonCommand(ctx, params)
+	return params
 }
 
 // NsenterSetArgs override args of nsenter command
@@ -0,0 +1,219 @@
+package kernelversion
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// KernelRelease is the parsed form of a kernel release string as reported by
+// `uname -r`, e.g.
+//
+//	3.10.0-1160.83.1.el7.x86_64              (RHEL/CentOS)
+//	5.15.0-105-generic                       (Ubuntu)
+//	6.1.0-18-cloud-amd64                     (Debian)
+//	5.14.21-150400.24.46-default             (SUSE)
+//	4.19.90-23.8.v2101.ky10.aarch64          (Kylin)
+//	5.10.0-60.18.0.50.oe2203.x86_64          (openEuler)
+//	4.18.0-348.el8.0.2.x86_64                (Rocky)
+//	5.15.12                                  (vanilla)
+type KernelRelease struct {
+	Major int
+	Minor int
+	Patch int
+	// Release is the distro build string between the upstream version and the
+	// distro tag, e.g. "1160.83.1" or "105". ABI is its first component.
+	Release string
+	// DistroTag is the distro identifier embedded in the release, e.g. "el7",
+	// "el9_0", "ky10" or "oe2203". Empty for distros without one.
+	DistroTag string
+	// ReleaseSuffix is the build string after the distro tag, e.g. "0.2" for
+	// "4.18.0-348.el8.0.2.x86_64". Empty for most releases.
+	ReleaseSuffix string
+	// Flavour is the kernel flavour, e.g. "generic", "aws", "default", "cloud"
+	Flavour string
+	// Arch is the machine suffix of the release, e.g. "x86_64" or "amd64".
+	// Empty when the release string doesn't carry one.
+	Arch string
+	// Original is the unmodified release string
+	Original string
+}
+
+var (
+	upstreamRegex  = regexp.MustCompile(`^(\d+)\.(\d+)(?:\.(\d+))?`)
+	distroTagRegex = regexp.MustCompile(`^(el|ky|oe|fc|an|amzn|al|uek|ctl|tl|uel)\d+\w*$`)
+
+	// arch suffixes appended with "." (rpm based distros)
+	dotArchSuffixes = []string{"x86_64", "aarch64", "ppc64le", "ppc64", "s390x", "i686", "armv7hl", "loongarch64", "riscv64", "mips64el", "sw_64"}
+	// arch suffixes appended with "-" (debian based distros)
+	dashArchSuffixes = []string{"amd64", "arm64", "armmp", "armmp-lpae", "ppc64el", "s390x", "686", "686-pae", "loong64", "riscv64"}
+)
+
+// Parse parses a kernel release string into a KernelRelease
+func Parse(release string) (*KernelRelease, error) {
+	kr := &KernelRelease{Original: release}
+
+	s := strings.TrimSpace(release)
+	m := upstreamRegex.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("failed to parse kernel release %q: no upstream version found", release)
+	}
+	kr.Major, _ = strconv.Atoi(m[1])
+	kr.Minor, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		kr.Patch, _ = strconv.Atoi(m[3])
+	}
+
+	// the rest looks like "-1160.83.1.el7.x86_64", "-105-generic" or "+"
+	rest := s[len(m[0]):]
+	rest = strings.TrimLeft(rest, "+")
+	if rest == "" {
+		return kr, nil
+	}
+	if !strings.HasPrefix(rest, "-") && !strings.HasPrefix(rest, ".") {
+		return nil, fmt.Errorf("failed to parse kernel release %q: unexpected %q after upstream version", release, rest)
+	}
+	rest = rest[1:]
+
+	for _, arch := range dotArchSuffixes {
+		if strings.HasSuffix(rest, "."+arch) {
+			kr.Arch = arch
+			rest = strings.TrimSuffix(rest, "."+arch)
+			break
+		}
+	}
+
+	// "-" separates release from flavour. debian style arch goes after flavour
+	parts := strings.Split(rest, "-")
+	kr.Release = parts[0]
+	flavours := parts[1:]
+	if kr.Arch == "" && len(flavours) > 0 {
+		for _, arch := range dashArchSuffixes {
+			archParts := strings.Split(arch, "-")
+			if len(flavours) < len(archParts) {
+				continue
+			}
+			if strings.Join(flavours[len(flavours)-len(archParts):], "-") == arch {
+				kr.Arch = arch
+				flavours = flavours[:len(flavours)-len(archParts)]
+				break
+			}
+		}
+	}
+	kr.Flavour = strings.Join(flavours, "-")
+
+	// the distro tag is the last field in release that looks like one, e.g.
+	// "el7" in "1160.83.1.el7", "ky10" in "23.8.v2101.ky10"
+	fields := strings.Split(kr.Release, ".")
+	for idx := len(fields) - 1; idx >= 0; idx-- {
+		if distroTagRegex.MatchString(fields[idx]) {
+			kr.DistroTag = fields[idx]
+			kr.Release = strings.Join(fields[:idx], ".")
+			kr.ReleaseSuffix = strings.Join(fields[idx+1:], ".")
+			break
+		}
+	}
+
+	return kr, nil
+}
+
+// MustParse is like Parse but panics if the release can't be parsed
+func MustParse(release string) *KernelRelease {
+	kr, err := Parse(release)
+	if err != nil {
+		panic(err)
+	}
+	return kr
+}
+
+// Version returns the upstream version, e.g. "3.10.0"
+func (k *KernelRelease) Version() string {
+	return fmt.Sprintf("%d.%d.%d", k.Major, k.Minor, k.Patch)
+}
+
+// ABI returns the first component of the release, which distros bump when
+// the kernel ABI changes, e.g. "1160" for "3.10.0-1160.83.1.el7.x86_64"
+// and "105" for "5.15.0-105-generic"
+func (k *KernelRelease) ABI() string {
+	return strings.SplitN(k.Release, ".", 2)[0]
+}
+
+// DistroFamily returns the distro tag without the minor release, e.g. "el9"
+// for "el9_0"
+func (k *KernelRelease) DistroFamily() string {
+	return strings.SplitN(k.DistroTag, "_", 2)[0]
+}
+
+// IsRHELLike reports whether the kernel belongs to a RHEL-compatible distro
+// with a kABI stable stream per major release
+func (k *KernelRelease) IsRHELLike() bool {
+	return strings.HasPrefix(k.DistroTag, "el") || strings.HasPrefix(k.DistroTag, "an")
+}
+
+func (k *KernelRelease) String() string {
+	return k.Original
+}
+
+// Compare returns -1, 0 or 1 when a is older than, equal to or newer than b.
+// Only the upstream version, the release and its suffix are taken into
+// account
+func Compare(a, b *KernelRelease) int {
+	for _, pair := range [][2]int{{a.Major, b.Major}, {a.Minor, b.Minor}, {a.Patch, b.Patch}} {
+		if c := compareInt(pair[0], pair[1]); c != 0 {
+			return c
+		}
+	}
+	if c := compareRelease(a.Release, b.Release); c != 0 {
+		return c
+	}
+	return compareRelease(a.ReleaseSuffix, b.ReleaseSuffix)
+}
+
+// Less reports whether k is older than other
+func (k *KernelRelease) Less(other *KernelRelease) bool {
+	return Compare(k, other) < 0
+}
+
+// Equal reports whether k and other have the same version, release and
+// release suffix
+func (k *KernelRelease) Equal(other *KernelRelease) bool {
+	return Compare(k, other) == 0
+}
+
+// compareRelease compares dot separated release strings field by field,
+// numerically where both fields are numbers, e.g. "1160.83.1" > "1160.9"
+func compareRelease(a, b string) int {
+	af, bf := splitRelease(a), splitRelease(b)
+	for idx := 0; idx < len(af) && idx < len(bf); idx++ {
+		an, aErr := strconv.Atoi(af[idx])
+		bn, bErr := strconv.Atoi(bf[idx])
+		if aErr == nil && bErr == nil {
+			if c := compareInt(an, bn); c != 0 {
+				return c
+			}
+			continue
+		}
+		if c := strings.Compare(af[idx], bf[idx]); c != 0 {
+			return c
+		}
+	}
+	return compareInt(len(af), len(bf))
+}
+
+func splitRelease(release string) []string {
+	if release == "" {
+		return nil
+	}
+	return strings.Split(release, ".")
+}
+
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,117 @@
+package kernelversion
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		release string
+		want    KernelRelease
+	}{
+		{"3.10.0-1160.83.1.el7.x86_64", KernelRelease{Major: 3, Minor: 10, Patch: 0, Release: "1160.83.1", DistroTag: "el7", Arch: "x86_64"}},
+		{"5.15.0-105-generic", KernelRelease{Major: 5, Minor: 15, Patch: 0, Release: "105", Flavour: "generic"}},
+		{"6.1.0-18-cloud-amd64", KernelRelease{Major: 6, Minor: 1, Patch: 0, Release: "18", Flavour: "cloud", Arch: "amd64"}},
+		{"6.1.0-18-armmp-lpae", KernelRelease{Major: 6, Minor: 1, Patch: 0, Release: "18", Arch: "armmp-lpae"}},
+		{"5.14.21-150400.24.46-default", KernelRelease{Major: 5, Minor: 14, Patch: 21, Release: "150400.24.46", Flavour: "default"}},
+		{"4.19.90-23.8.v2101.ky10.aarch64", KernelRelease{Major: 4, Minor: 19, Patch: 90, Release: "23.8.v2101", DistroTag: "ky10", Arch: "aarch64"}},
+		{"5.10.0-60.18.0.50.oe2203.x86_64", KernelRelease{Major: 5, Minor: 10, Patch: 0, Release: "60.18.0.50", DistroTag: "oe2203", Arch: "x86_64"}},
+		{"4.18.0-348.el8.0.2.x86_64", KernelRelease{Major: 4, Minor: 18, Patch: 0, Release: "348", DistroTag: "el8", ReleaseSuffix: "0.2", Arch: "x86_64"}},
+		{"5.14.0-70.13.1.el9_0.ppc64le", KernelRelease{Major: 5, Minor: 14, Patch: 0, Release: "70.13.1", DistroTag: "el9_0", Arch: "ppc64le"}},
+		{"5.15.12", KernelRelease{Major: 5, Minor: 15, Patch: 12}},
+		{"5.15+", KernelRelease{Major: 5, Minor: 15}},
+	} {
+		t.Run(tc.release, func(t *testing.T) {
+			got, err := Parse(tc.release)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			tc.want.Original = tc.release
+			if *got != tc.want {
+				t.Errorf("Parse() = %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, release := range []string{"", "linux", "5", "5.15_0"} {
+		if _, err := Parse(release); err == nil {
+			t.Errorf("Parse(%q) error = nil, want error", release)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"3.10.0-1160.83.1.el7.x86_64", "3.10.0-1160.83.1.el7.x86_64", 0},
+		{"3.10.0-1160.83.1.el7.x86_64", "3.10.0-1160.9.1.el7.x86_64", 1},
+		{"3.10.0-1160.el7.x86_64", "3.10.0-1160.83.1.el7.x86_64", -1},
+		{"4.18.0-348.el8.0.2.x86_64", "4.18.0-348.el8.x86_64", 1},
+		{"4.18.0-348.el8.0.2.x86_64", "4.18.0-348.el8.0.10.x86_64", -1},
+		{"5.15.0-105-generic", "5.15.0-105-aws", 0},
+		{"5.15.0-105-generic", "5.15.0-91-generic", 1},
+		{"5.4.0-105-generic", "5.15.0-91-generic", -1},
+		{"5.15.12", "5.15.2", 1},
+		{"6.1.0-18-cloud-amd64", "6.1.0-18-amd64", 0},
+	} {
+		a, b := MustParse(tc.a), MustParse(tc.b)
+		if got := Compare(a, b); got != tc.want {
+			t.Errorf("Compare(%s, %s) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := Compare(b, a); got != -tc.want {
+			t.Errorf("Compare(%s, %s) = %d, want %d", tc.b, tc.a, got, -tc.want)
+		}
+		if got := a.Equal(b); got != (tc.want == 0) {
+			t.Errorf("%s.Equal(%s) = %t, want %t", tc.a, tc.b, got, tc.want == 0)
+		}
+		if got := a.Less(b); got != (tc.want < 0) {
+			t.Errorf("%s.Less(%s) = %t, want %t", tc.a, tc.b, got, tc.want < 0)
+		}
+	}
+}
+
+func TestABI(t *testing.T) {
+	for release, want := range map[string]string{
+		"3.10.0-1160.83.1.el7.x86_64":     "1160",
+		"5.15.0-105-generic":              "105",
+		"5.14.21-150400.24.46-default":    "150400",
+		"4.18.0-348.el8.0.2.x86_64":       "348",
+		"5.10.0-60.18.0.50.oe2203.x86_64": "60",
+		"5.15.12":                         "",
+	} {
+		if got := MustParse(release).ABI(); got != want {
+			t.Errorf("ABI() of %s = %q, want %q", release, got, want)
+		}
+	}
+}
+
+func TestDistroFamily(t *testing.T) {
+	for release, want := range map[string]string{
+		"5.14.0-70.13.1.el9_0.x86_64":     "el9",
+		"3.10.0-1160.83.1.el7.x86_64":     "el7",
+		"4.19.90-23.8.v2101.ky10.aarch64": "ky10",
+		"5.15.0-105-generic":              "",
+	} {
+		if got := MustParse(release).DistroFamily(); got != want {
+			t.Errorf("DistroFamily() of %s = %q, want %q", release, got, want)
+		}
+	}
+}
+
+func TestIsRHELLike(t *testing.T) {
+	for release, want := range map[string]bool{
+		"3.10.0-1160.83.1.el7.x86_64":     true,
+		"4.18.0-348.el8.0.2.x86_64":       true,
+		"4.19.91-26.an8.x86_64":           true,
+		"5.10.0-60.18.0.50.oe2203.x86_64": false,
+		"5.15.0-105-generic":              false,
+	} {
+		if got := MustParse(release).IsRHELLike(); got != want {
+			t.Errorf("IsRHELLike() of %s = %t, want %t", release, got, want)
+		}
+	}
+}
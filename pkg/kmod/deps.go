@@ -0,0 +1,114 @@
+package kmod
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// NormalizeName turns a mod name or file into the name the kernel uses,
+// e.g. "kernel/lib/libcrc32c.ko.xz" into "libcrc32c"
+func NormalizeName(name string) string {
+	name = path.Base(name)
+	for _, ext := range []string{".xz", ".gz", ".zst"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	name = strings.TrimSuffix(name, ".ko")
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// ParseModulesDep collects the mods listed in modules.dep, whose lines look
+// like "kernel/lib/libcrc32c.ko.xz: " or "extra/drbd90/drbd.ko: kernel/lib/libcrc32c.ko.xz"
+func ParseModulesDep(reader io.Reader) (map[string]string, error) {
+	modules := map[string]string{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			continue
+		}
+		modules[NormalizeName(line[:idx])] = line[:idx]
+	}
+	return modules, scanner.Err()
+}
+
+// ParseModulesBuiltin collects the mods built into the kernel listed in
+// modules.builtin, whose lines look like "kernel/lib/libcrc32c.ko"
+func ParseModulesBuiltin(reader io.Reader) (map[string]bool, error) {
+	modules := map[string]bool{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			modules[NormalizeName(line)] = true
+		}
+	}
+	return modules, scanner.Err()
+}
+
+// SortByDependencies orders mods so that every mod comes after the ones it
+// depends on, keeping the given order otherwise. Dependencies out of mods are
+// ignored here
+func SortByDependencies(mods []*ModInfo) ([]*ModInfo, error) {
+	byName := map[string]*ModInfo{}
+	for _, mod := range mods {
+		byName[NormalizeName(mod.Name)] = mod
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var sorted []*ModInfo
+	var visit func(mod *ModInfo, chain []string) error
+	visit = func(mod *ModInfo, chain []string) error {
+		name := NormalizeName(mod.Name)
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("circular dependency of kernel mods: %s", strings.Join(append(chain, name), " -> "))
+		}
+		state[name] = visiting
+		for _, dep := range mod.Depends {
+			if depMod, exists := byName[NormalizeName(dep)]; exists {
+				if err := visit(depMod, append(chain, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = visited
+		sorted = append(sorted, mod)
+		return nil
+	}
+
+	for _, mod := range mods {
+		if err := visit(mod, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// ExternalDepends returns the dependencies of mods which are not in mods
+// themselves, mapped to the mods requiring them
+func ExternalDepends(mods []*ModInfo) map[string][]string {
+	names := map[string]bool{}
+	for _, mod := range mods {
+		names[NormalizeName(mod.Name)] = true
+	}
+
+	external := map[string][]string{}
+	for _, mod := range mods {
+		for _, dep := range mod.Depends {
+			if dep = NormalizeName(dep); !names[dep] {
+				external[dep] = append(external[dep], mod.Name)
+			}
+		}
+	}
+	return external
+}
@@ -0,0 +1,174 @@
+package kmod
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	modinfoSection  = ".modinfo"
+	versionsSection = "__versions"
+)
+
+// ModInfo is the metadata of a kernel mod read from its ELF file
+type ModInfo struct {
+	Path       string
+	Machine    elf.Machine
+	Name       string
+	Version    string
+	SrcVersion string
+	VerMagic   string
+	Depends    []string
+	// HasModVersions is true if the mod carries symbol CRCs in __versions
+	HasModVersions bool
+}
+
+// ReadModInfo parses the ELF header and .modinfo section of the kernel mod file
+func ReadModInfo(path string) (*ModInfo, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s as ELF: %w", path, err)
+	}
+	defer file.Close()
+
+	if file.Type != elf.ET_REL {
+		return nil, fmt.Errorf("%s is not a kernel mod: ELF type is %s", path, file.Type)
+	}
+
+	section := file.Section(modinfoSection)
+	if section == nil {
+		return nil, fmt.Errorf("%s is not a kernel mod: no %s section", path, modinfoSection)
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s section of %s: %w", modinfoSection, path, err)
+	}
+
+	info := ParseModInfo(data)
+	info.Path = path
+	info.Machine = file.Machine
+	info.HasModVersions = file.Section(versionsSection) != nil
+	if info.Name == "" {
+		// old kernels don't record the name in .modinfo
+		info.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return info, nil
+}
+
+// ParseModInfo parses the content of a .modinfo section, which is a list of
+// NUL terminated "key=value" entries
+func ParseModInfo(data []byte) *ModInfo {
+	info := &ModInfo{}
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		kv := strings.SplitN(string(entry), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "name":
+			info.Name = kv[1]
+		case "version":
+			info.Version = kv[1]
+		case "srcversion":
+			info.SrcVersion = kv[1]
+		case "vermagic":
+			info.VerMagic = strings.TrimSpace(kv[1])
+		case "depends":
+			for _, dep := range strings.Split(kv[1], ",") {
+				if dep != "" {
+					info.Depends = append(info.Depends, dep)
+				}
+			}
+		}
+	}
+	return info
+}
+
+// VerMagicRelease returns the kernel release the mod was built against,
+// which is the first field of vermagic
+func (m *ModInfo) VerMagicRelease() string {
+	release, _ := SplitVerMagic(m.VerMagic)
+	return release
+}
+
+// SplitVerMagic splits vermagic like "4.18.0-348.el8.x86_64 SMP mod_unload
+// modversions" into the kernel release and the flags of the kernel config
+// that follow it, with the flags separated by single spaces
+func SplitVerMagic(vermagic string) (string, string) {
+	fields := strings.Fields(vermagic)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	return fields[0], strings.Join(fields[1:], " ")
+}
+
+// MismatchError reports a field of a kernel mod that disagrees with the host
+type MismatchError struct {
+	Path  string
+	Field string
+	Mod   string
+	Host  string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s doesn't fit host: %s of mod is %q, host has %q", e.Path, e.Field, e.Mod, e.Host)
+}
+
+// CheckHost validates the mod against the host kernel release and machine
+// (`uname -r` and `uname -m`) and the vermagic flags of the host kernel, e.g.
+// "SMP mod_unload modversions", which are not checked if hostFlags is empty.
+// The kernel release in vermagic may differ from the host's if the mod
+// carries modversions and strict is false, as the kernel itself only compares
+// symbol CRCs and the flags in that case
+func (m *ModInfo) CheckHost(kernelRelease, machine, hostFlags string, strict bool) error {
+	hostMachine, ok := MachineOf(machine)
+	if !ok {
+		return fmt.Errorf("unknown host machine %q", machine)
+	}
+	if m.Machine != hostMachine {
+		return &MismatchError{Path: m.Path, Field: "e_machine", Mod: m.Machine.String(), Host: hostMachine.String()}
+	}
+
+	if m.VerMagic == "" {
+		return &MismatchError{Path: m.Path, Field: "vermagic", Mod: "", Host: kernelRelease}
+	}
+	release, flags := SplitVerMagic(m.VerMagic)
+	if release != kernelRelease && (strict || !m.HasModVersions) {
+		return &MismatchError{Path: m.Path, Field: "vermagic", Mod: release, Host: kernelRelease}
+	}
+	if hostFlags = strings.Join(strings.Fields(hostFlags), " "); hostFlags != "" && flags != hostFlags {
+		return &MismatchError{Path: m.Path, Field: "vermagic flags", Mod: flags, Host: hostFlags}
+	}
+	return nil
+}
+
+// emLoongArch is the ELF e_machine of LoongArch, debug/elf defines it as
+// EM_LOONGARCH from go 1.19 only
+const emLoongArch elf.Machine = 258
+
+// MachineOf maps the machine reported by `uname -m` to its ELF e_machine
+func MachineOf(machine string) (elf.Machine, bool) {
+	switch machine {
+	case "x86_64":
+		return elf.EM_X86_64, true
+	case "i386", "i486", "i586", "i686":
+		return elf.EM_386, true
+	case "aarch64", "arm64":
+		return elf.EM_AARCH64, true
+	case "ppc64", "ppc64le":
+		return elf.EM_PPC64, true
+	case "s390x":
+		return elf.EM_S390, true
+	case "riscv64":
+		return elf.EM_RISCV, true
+	case "loongarch64", "loong64":
+		return emLoongArch, true
+	}
+	if strings.HasPrefix(machine, "arm") {
+		return elf.EM_ARM, true
+	}
+	return elf.EM_NONE, false
+}
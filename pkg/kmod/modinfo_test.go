@@ -0,0 +1,149 @@
+package kmod
+
+import (
+	"debug/elf"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestParseModInfo(t *testing.T) {
+	for _, tc := range []struct {
+		fixture string
+		want    ModInfo
+	}{
+		{"testdata/drbd.modinfo", ModInfo{
+			Name:       "drbd",
+			Version:    "9.1.11",
+			SrcVersion: "4B4E7BDD9AA89AA2E2B1B5A",
+			VerMagic:   "4.18.0-348.el8.x86_64 SMP mod_unload modversions",
+			Depends:    []string{"libcrc32c"},
+		}},
+		// old kernels record neither name nor version
+		{"testdata/legacy.modinfo", ModInfo{
+			SrcVersion: "0A1B2C3D4E5F",
+			VerMagic:   "3.10.0-1160.el7.x86_64 SMP mod_unload modversions",
+		}},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			data, err := ioutil.ReadFile(tc.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ParseModInfo(data); !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("ParseModInfo() = %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerMagicRelease(t *testing.T) {
+	info := &ModInfo{VerMagic: "4.18.0-348.el8.x86_64 SMP mod_unload modversions"}
+	if got := info.VerMagicRelease(); got != "4.18.0-348.el8.x86_64" {
+		t.Errorf("VerMagicRelease() = %q", got)
+	}
+}
+
+func TestMachineOf(t *testing.T) {
+	for machine, want := range map[string]elf.Machine{
+		"x86_64":      elf.EM_X86_64,
+		"i686":        elf.EM_386,
+		"aarch64":     elf.EM_AARCH64,
+		"armv7l":      elf.EM_ARM,
+		"ppc64le":     elf.EM_PPC64,
+		"s390x":       elf.EM_S390,
+		"riscv64":     elf.EM_RISCV,
+		"loongarch64": emLoongArch,
+	} {
+		if got, ok := MachineOf(machine); !ok || got != want {
+			t.Errorf("MachineOf(%q) = %v, %t, want %v", machine, got, ok, want)
+		}
+	}
+	if _, ok := MachineOf("sparc64"); ok {
+		t.Error(`MachineOf("sparc64") ok = true, want false`)
+	}
+}
+
+const shippedBuildsDir = "../../kernel-mods/drbd/linux/"
+
+func TestReadModInfoShipped(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		name     string
+		machine  elf.Machine
+		vermagic string
+		depends  string
+	}{
+		{"3.10.0/1160/amd64/drbd.ko", "drbd", elf.EM_X86_64, "3.10.0-1160.el7.x86_64 SMP mod_unload modversions", "libcrc32c"},
+		{"3.10.0/1160/amd64/drbd_transport_tcp.ko", "drbd_transport_tcp", elf.EM_X86_64, "3.10.0-1160.el7.x86_64 SMP mod_unload modversions", "drbd"},
+		{"4.19.90/23/arm/drbd_transport_tcp.ko", "drbd_transport_tcp", elf.EM_AARCH64, "4.19.90-23.8.v2101.ky10.aarch64 SMP mod_unload modversions aarch64", "drbd"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			info, err := ReadModInfo(shippedBuildsDir + tc.path)
+			if err != nil {
+				t.Fatalf("ReadModInfo() error = %v", err)
+			}
+			if info.Name != tc.name || info.Machine != tc.machine || info.VerMagic != tc.vermagic || !info.HasModVersions {
+				t.Errorf("ReadModInfo() = %+v", info)
+			}
+			if len(info.Depends) != 1 || info.Depends[0] != tc.depends {
+				t.Errorf("Depends = %v, want [%s]", info.Depends, tc.depends)
+			}
+		})
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	drbd, err := ReadModInfo(shippedBuildsDir + "3.10.0/1160/amd64/drbd.ko")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := ReadModInfo(shippedBuildsDir + "4.19.90/23/arm/drbd_transport_tcp.ko")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		mod       *ModInfo
+		release   string
+		machine   string
+		hostFlags string
+		strict    bool
+		field     string
+	}{
+		{"same kernel", drbd, "3.10.0-1160.el7.x86_64", "x86_64", "SMP mod_unload modversions", false, ""},
+		{"host flags unknown", drbd, "3.10.0-1160.el7.x86_64", "x86_64", "", false, ""},
+		{"modversions across releases", drbd, "3.10.0-1160.83.1.el7.x86_64", "x86_64", "SMP mod_unload modversions ", false, ""},
+		{"strict release", drbd, "3.10.0-1160.83.1.el7.x86_64", "x86_64", "SMP mod_unload modversions", true, "vermagic"},
+		{"realtime kernel", drbd, "3.10.0-1160.83.1.rt56.1233.el7.x86_64", "x86_64", "SMP preempt mod_unload modversions", false, "vermagic flags"},
+		{"non-SMP kernel", drbd, "3.10.0-1160.el7.x86_64", "x86_64", "mod_unload modversions", false, "vermagic flags"},
+		{"other machine", drbd, "3.10.0-1160.el7.x86_64", "aarch64", "SMP mod_unload modversions", false, "e_machine"},
+		{"arch flag", transport, "4.19.90-23.8.v2101.ky10.aarch64", "aarch64", "SMP mod_unload modversions aarch64", false, ""},
+		{"missing arch flag", transport, "4.19.90-23.8.v2101.ky10.aarch64", "aarch64", "SMP mod_unload modversions", false, "vermagic flags"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.mod.CheckHost(tc.release, tc.machine, tc.hostFlags, tc.strict)
+			if tc.field == "" {
+				if err != nil {
+					t.Errorf("CheckHost() error = %v", err)
+				}
+				return
+			}
+			if mismatch, ok := err.(*MismatchError); !ok || mismatch.Field != tc.field {
+				t.Errorf("CheckHost() error = %v, want %s mismatch", err, tc.field)
+			}
+		})
+	}
+
+	if err := drbd.CheckHost("3.10.0-1160.el7.x86_64", "sparc64", "", false); err == nil {
+		t.Error("CheckHost() on unknown machine error = nil")
+	}
+}
+
+func TestSplitVerMagic(t *testing.T) {
+	release, flags := SplitVerMagic("4.19.90-23.8.v2101.ky10.aarch64 SMP mod_unload modversions aarch64\n")
+	if release != "4.19.90-23.8.v2101.ky10.aarch64" || flags != "SMP mod_unload modversions aarch64" {
+		t.Errorf("SplitVerMagic() = %q, %q", release, flags)
+	}
+}
@@ -0,0 +1,43 @@
+package kmod
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ProcModulesPath lists the loaded kernel mods. It's not namespaced, so the
+// container sees the same as the host
+const ProcModulesPath = "/proc/modules"
+
+// LoadedModule is a kernel mod loaded in the running kernel
+type LoadedModule struct {
+	Name     string
+	RefCount int
+	// UsedBy are the mods depending on this one
+	UsedBy []string
+	State  string
+}
+
+// ParseProcModules parses /proc/modules, whose lines look like
+// "drbd 568497 1 drbd_transport_tcp, Live 0x0000000000000000 (OE)"
+func ParseProcModules(reader io.Reader) (map[string]*LoadedModule, error) {
+	modules := map[string]*LoadedModule{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		module := &LoadedModule{Name: fields[0], State: fields[4]}
+		module.RefCount, _ = strconv.Atoi(fields[2])
+		for _, user := range strings.Split(fields[3], ",") {
+			if user != "" && user != "-" {
+				module.UsedBy = append(module.UsedBy, user)
+			}
+		}
+		modules[module.Name] = module
+	}
+	return modules, scanner.Err()
+}
@@ -0,0 +1,204 @@
+package kmod
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// modversion_info is { unsigned long crc; char name[64 - sizeof(unsigned long)]; }
+	modVersionInfoSize = 64
+
+	ksymtabPrefix = "__ksymtab_"
+)
+
+// SymbolCRC is a symbol a kernel mod imports along with the CRC of its
+// prototype it was built with
+type SymbolCRC struct {
+	Name string
+	CRC  uint32
+}
+
+// ReadModVersions parses the __versions section of the kernel mod file. It
+// returns nothing if the mod was built without modversions
+func ReadModVersions(path string) ([]SymbolCRC, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s as ELF: %w", path, err)
+	}
+	defer file.Close()
+
+	section := file.Section(versionsSection)
+	if section == nil {
+		return nil, nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s section of %s: %w", versionsSection, path, err)
+	}
+
+	crcSize := 8
+	if file.Class == elf.ELFCLASS32 {
+		crcSize = 4
+	}
+
+	var symbols []SymbolCRC
+	for offset := 0; offset+modVersionInfoSize <= len(data); offset += modVersionInfoSize {
+		entry := data[offset : offset+modVersionInfoSize]
+		var crc uint64
+		if crcSize == 8 {
+			crc = file.ByteOrder.Uint64(entry[:8])
+		} else {
+			crc = uint64(file.ByteOrder.Uint32(entry[:4]))
+		}
+		name := entry[crcSize:]
+		if end := strings.IndexByte(string(name), 0); end >= 0 {
+			name = name[:end]
+		}
+		symbols = append(symbols, SymbolCRC{Name: string(name), CRC: uint32(crc)})
+	}
+	return symbols, nil
+}
+
+// ReadExportedSymbols lists the symbols the kernel mod file exports
+func ReadExportedSymbols(path string) ([]string, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s as ELF: %w", path, err)
+	}
+	defer file.Close()
+
+	symbols, err := file.Symbols()
+	if err == elf.ErrNoSymbols {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var exported []string
+	for _, symbol := range symbols {
+		if strings.HasPrefix(symbol.Name, ksymtabPrefix) {
+			exported = append(exported, strings.TrimPrefix(symbol.Name, ksymtabPrefix))
+		}
+	}
+	return exported, nil
+}
+
+// ParseSymvers parses a Module.symvers file, whose lines look like
+// "0x12345678	symbol	vmlinux	EXPORT_SYMBOL[	namespace]"
+func ParseSymvers(reader io.Reader) (map[string]uint32, error) {
+	crcs := map[string]uint32{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		crc, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid symvers line %q: %w", scanner.Text(), err)
+		}
+		crcs[fields[1]] = uint32(crc)
+	}
+	return crcs, scanner.Err()
+}
+
+// ParseKallsymsExports collects the symbols exported by the kernel and its
+// loaded mods from the "__ksymtab_<symbol>" entries of /proc/kallsyms. The
+// "__crc_<symbol>" entries are not used, they aren't the CRCs on kernels with
+// relative CRCs, and addresses may be hidden
+func ParseKallsymsExports(reader io.Reader) (map[string]bool, error) {
+	exported := map[string]bool{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[2], ksymtabPrefix) {
+			continue
+		}
+		exported[strings.TrimPrefix(fields[2], ksymtabPrefix)] = true
+	}
+	return exported, scanner.Err()
+}
+
+// CRCMismatch is an imported symbol whose CRC differs from the host's
+type CRCMismatch struct {
+	Symbol  string
+	ModCRC  uint32
+	HostCRC uint32
+}
+
+// SymbolCheckError reports the symbols of a kernel mod the host kernel can't
+// resolve, which would make loading it fail
+type SymbolCheckError struct {
+	Path           string
+	UnknownSymbols []string
+	Mismatches     []CRCMismatch
+}
+
+func (e *SymbolCheckError) Error() string {
+	var problems []string
+	for _, symbol := range e.UnknownSymbols {
+		problems = append(problems, fmt.Sprintf("unknown symbol %s", symbol))
+	}
+	for _, mismatch := range e.Mismatches {
+		problems = append(problems, fmt.Sprintf("CRC mismatch of %s: mod 0x%08x, host 0x%08x", mismatch.Symbol, mismatch.ModCRC, mismatch.HostCRC))
+	}
+	return fmt.Sprintf("%s doesn't fit host kernel: %s", e.Path, strings.Join(problems, "; "))
+}
+
+// CheckSymbols checks the symbols imported by the mod at path are exported by
+// the host, without comparing their CRCs. Symbols in provided are exported by
+// other mods installed along with this one
+func CheckSymbols(path string, exported map[string]bool, provided map[string]bool) error {
+	symbols, err := ReadModVersions(path)
+	if err != nil {
+		return err
+	}
+
+	checkErr := &SymbolCheckError{Path: path}
+	for _, symbol := range symbols {
+		if !provided[symbol.Name] && !exported[symbol.Name] {
+			checkErr.UnknownSymbols = append(checkErr.UnknownSymbols, symbol.Name)
+		}
+	}
+	if len(checkErr.UnknownSymbols) == 0 {
+		return nil
+	}
+	sort.Strings(checkErr.UnknownSymbols)
+	return checkErr
+}
+
+// CheckSymbolCRCs compares the symbols imported by the mod at path with the
+// CRCs exported by the host kernel. Symbols in provided are exported by other
+// mods installed along with this one and are not looked up on the host
+func CheckSymbolCRCs(path string, hostCRCs map[string]uint32, provided map[string]bool) error {
+	symbols, err := ReadModVersions(path)
+	if err != nil {
+		return err
+	}
+
+	checkErr := &SymbolCheckError{Path: path}
+	for _, symbol := range symbols {
+		if provided[symbol.Name] {
+			continue
+		}
+		hostCRC, exists := hostCRCs[symbol.Name]
+		if !exists {
+			checkErr.UnknownSymbols = append(checkErr.UnknownSymbols, symbol.Name)
+			continue
+		}
+		if hostCRC != symbol.CRC {
+			checkErr.Mismatches = append(checkErr.Mismatches, CRCMismatch{Symbol: symbol.Name, ModCRC: symbol.CRC, HostCRC: hostCRC})
+		}
+	}
+	if len(checkErr.UnknownSymbols) == 0 && len(checkErr.Mismatches) == 0 {
+		return nil
+	}
+	sort.Strings(checkErr.UnknownSymbols)
+	return checkErr
+}
@@ -0,0 +1,53 @@
+package kmod
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSymvers(t *testing.T) {
+	file, err := os.Open("testdata/Module.symvers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	crcs, err := ParseSymvers(file)
+	if err != nil {
+		t.Fatalf("ParseSymvers() error = %v", err)
+	}
+	want := map[string]uint32{
+		"queue_work_on": 0x7ad050b9,
+		"crc32c":        0x4d4d9ff3,
+		"__put_user_4":  0xb2fd5ceb,
+		"dma_buf_get":   0x92997ed8,
+	}
+	if !reflect.DeepEqual(crcs, want) {
+		t.Errorf("ParseSymvers() = %v, want %v", crcs, want)
+	}
+}
+
+func TestParseSymversInvalid(t *testing.T) {
+	if _, err := ParseSymvers(strings.NewReader("not-a-crc\tsymbol\tvmlinux\tEXPORT_SYMBOL\n")); err == nil {
+		t.Error("ParseSymvers() error = nil, want invalid line error")
+	}
+}
+
+func TestParseKallsymsExports(t *testing.T) {
+	file, err := os.Open("testdata/kallsyms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	exported, err := ParseKallsymsExports(file)
+	if err != nil {
+		t.Fatalf("ParseKallsymsExports() error = %v", err)
+	}
+	want := map[string]bool{"queue_work_on": true, "crc32c": true}
+	if !reflect.DeepEqual(exported, want) {
+		t.Errorf("ParseKallsymsExports() = %v, want %v", exported, want)
+	}
+}
@@ -0,0 +1,153 @@
+package kube
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// ServiceAccountDir holds the credentials of the pod service account
+	ServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	MergePatchType = "application/merge-patch+json"
+
+	requestTimeout = 10 * time.Second
+)
+
+// Client is a minimal client of the Kubernetes API, only covering what the
+// installer needs, to keep client-go out of its dependencies
+type Client struct {
+	// BaseURL is the URL of the API server, e.g. https://10.96.0.1:443
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+func NewClient(baseURL, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: requestTimeout}
+	}
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token, HTTPClient: httpClient}
+}
+
+// NewInClusterClient uses the service account of the pod. If baseURL is
+// empty, the API server is found from the environment set by Kubernetes
+func NewInClusterClient(baseURL string) (*Client, error) {
+	if baseURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a Kubernetes cluster")
+		}
+		baseURL = "https://" + net.JoinHostPort(host, port)
+	}
+
+	token, err := ioutil.ReadFile(ServiceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(ServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s/ca.crt", ServiceAccountDir)
+	}
+
+	httpClient := &http.Client{
+		Timeout:   requestTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	return NewClient(baseURL, strings.TrimSpace(string(token)), httpClient), nil
+}
+
+// StatusError is returned for a response out of 2xx
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d: %s", e.Code, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the API server
+func IsNotFound(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.Code == http.StatusNotFound
+}
+
+// do sends body encoded as JSON to path and decodes the response into out,
+// either may be nil
+func (c *Client) do(method, path, contentType string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		status := struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(data))
+		}
+		return &StatusError{Code: resp.StatusCode, Message: status.Message}
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// PatchNode applies a JSON merge patch to the node, a nil value of a label or
+// annotation removes it
+func (c *Client) PatchNode(name string, patch interface{}) error {
+	return c.do(http.MethodPatch, "/api/v1/nodes/"+name, MergePatchType, patch, nil)
+}
+
+// CreateEvent creates the event in namespace
+func (c *Client) CreateEvent(namespace string, event *Event) error {
+	return c.do(http.MethodPost, "/api/v1/namespaces/"+namespace+"/events", "application/json", event, nil)
+}
+
+// PatchEvent applies a JSON merge patch to the event
+func (c *Client) PatchEvent(namespace, name string, patch interface{}) error {
+	return c.do(http.MethodPatch, "/api/v1/namespaces/"+namespace+"/events/"+name, MergePatchType, patch, nil)
+}
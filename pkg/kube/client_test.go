@@ -0,0 +1,156 @@
+package kube
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeRequest is a request received by fakeAPIServer
+type fakeRequest struct {
+	Method        string
+	Path          string
+	ContentType   string
+	Authorization string
+	Body          map[string]interface{}
+}
+
+// fakeAPIServer records the requests it receives and replies with status,
+// 200 by default
+type fakeAPIServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []fakeRequest
+	status   int
+	message  string
+}
+
+func newFakeAPIServer(t *testing.T) *fakeAPIServer {
+	s := &fakeAPIServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request body: %v", err)
+		}
+		req := fakeRequest{
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			ContentType:   r.Header.Get("Content-Type"),
+			Authorization: r.Header.Get("Authorization"),
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &req.Body); err != nil {
+				t.Errorf("request body is not JSON: %v", err)
+			}
+		}
+
+		s.lock.Lock()
+		s.requests = append(s.requests, req)
+		status, message := s.status, s.message
+		s.lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "code": status, "message": message})
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeAPIServer) reply(status int, message string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status, s.message = status, message
+}
+
+func (s *fakeAPIServer) received() []fakeRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]fakeRequest(nil), s.requests...)
+}
+
+func TestPatchNode(t *testing.T) {
+	server := newFakeAPIServer(t)
+	client := NewClient(server.URL+"/", "secret-token", nil)
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{"a": "b", "c": nil},
+		},
+	}
+	if err := client.PatchNode("node-1", patch); err != nil {
+		t.Fatalf("PatchNode() error = %v", err)
+	}
+
+	requests := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	if req.Method != http.MethodPatch {
+		t.Errorf("method = %s, want PATCH", req.Method)
+	}
+	if req.Path != "/api/v1/nodes/node-1" {
+		t.Errorf("path = %s, want /api/v1/nodes/node-1", req.Path)
+	}
+	if req.ContentType != MergePatchType {
+		t.Errorf("content type = %s, want %s", req.ContentType, MergePatchType)
+	}
+	if req.Authorization != "Bearer secret-token" {
+		t.Errorf("authorization = %q, want bearer token", req.Authorization)
+	}
+	labels := req.Body["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if labels["a"] != "b" {
+		t.Errorf("label a = %v, want b", labels["a"])
+	}
+	if value, exists := labels["c"]; !exists || value != nil {
+		t.Errorf("label c = %v (exists %t), want null", value, exists)
+	}
+}
+
+func TestPatchNodeWithoutToken(t *testing.T) {
+	server := newFakeAPIServer(t)
+	if err := NewClient(server.URL, "", nil).PatchNode("node-1", map[string]interface{}{}); err != nil {
+		t.Fatalf("PatchNode() error = %v", err)
+	}
+	if auth := server.received()[0].Authorization; auth != "" {
+		t.Errorf("authorization = %q, want none", auth)
+	}
+}
+
+func TestPatchNodeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		status   int
+		message  string
+		notFound bool
+	}{
+		{"not found", http.StatusNotFound, `nodes "node-1" not found`, true},
+		{"forbidden", http.StatusForbidden, `nodes "node-1" is forbidden: User "system:serviceaccount:kube-system:default" cannot patch resource "nodes"`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeAPIServer(t)
+			server.reply(tc.status, tc.message)
+
+			err := NewClient(server.URL, "token", nil).PatchNode("node-1", map[string]interface{}{})
+			statusErr, ok := err.(*StatusError)
+			if !ok {
+				t.Fatalf("PatchNode() error = %v, want *StatusError", err)
+			}
+			if statusErr.Code != tc.status || statusErr.Message != tc.message {
+				t.Errorf("StatusError = {%d, %q}, want {%d, %q}", statusErr.Code, statusErr.Message, tc.status, tc.message)
+			}
+			if IsNotFound(err) != tc.notFound {
+				t.Errorf("IsNotFound() = %t, want %t", IsNotFound(err), tc.notFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hwameistor/drbd-installer/pkg/drbd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EventComponent = "drbd-installer"
+	// NodeEventNamespace is where events of nodes are posted, as kubelet does
+	NodeEventNamespace = "default"
+
+	EventTypeNormal  = "Normal"
+	EventTypeWarning = "Warning"
+
+	eventMessageMaxLength = 1024
+	eventQueueSize        = 100
+	// eventCacheSize bounds the events remembered for de-duplication
+	eventCacheSize = 256
+)
+
+// ObjectReference refers to the object an event is about
+type ObjectReference struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	UID        string `json:"uid,omitempty"`
+}
+
+type ObjectMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type EventSource struct {
+	Component string `json:"component,omitempty"`
+	Host      string `json:"host,omitempty"`
+}
+
+// Event is a core/v1 Event
+type Event struct {
+	Metadata           ObjectMeta      `json:"metadata"`
+	InvolvedObject     ObjectReference `json:"involvedObject"`
+	Reason             string          `json:"reason"`
+	Message            string          `json:"message"`
+	Type               string          `json:"type"`
+	Source             EventSource     `json:"source"`
+	FirstTimestamp     time.Time       `json:"firstTimestamp"`
+	LastTimestamp      time.Time       `json:"lastTimestamp"`
+	Count              int             `json:"count"`
+	ReportingComponent string          `json:"reportingComponent"`
+	ReportingInstance  string          `json:"reportingInstance"`
+}
+
+// NodeReference refers to the node, its UID is its name as kubelet sets it
+func NodeReference(name string) ObjectReference {
+	return ObjectReference{APIVersion: "v1", Kind: "Node", Name: name, UID: name}
+}
+
+func PodReference(namespace, name, uid string) ObjectReference {
+	return ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: namespace, Name: name, UID: uid}
+}
+
+// EventRecorder posts events of the install pipeline stages against the node
+// and the pod of the installer. Events are posted in background so a slow API
+// server doesn't hold the stages up. An event repeating one already posted,
+// e.g. by every reconcile pass, bumps its count instead of adding another
+type EventRecorder struct {
+	Client *Client
+	// Objects are the objects events are posted against
+	Objects []ObjectReference
+	// Host is the node the events come from
+	Host string
+
+	lock    sync.Mutex
+	stopped bool
+	queue   chan drbd.StageEvent
+	done    chan struct{}
+	// posted are the events posted, by object, reason and message
+	posted map[string]*Event
+}
+
+func NewEventRecorder(client *Client, host string, objects ...ObjectReference) *EventRecorder {
+	r := &EventRecorder{
+		Client:  client,
+		Objects: objects,
+		Host:    host,
+		queue:   make(chan drbd.StageEvent, eventQueueSize),
+		done:    make(chan struct{}),
+		posted:  map[string]*Event{},
+	}
+	go r.run()
+	return r
+}
+
+// Observe queues events of the stage, it's registered with
+// drbd.DRBDKernelModInstaller.AddStageObserver. They are dropped if the
+// queue is full
+func (r *EventRecorder) Observe(event drbd.StageEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return
+	}
+	select {
+	case r.queue <- event:
+	default:
+		log.WithField("stage", event.Stage).Warn("Too many events queued, drop event of stage")
+	}
+}
+
+// Stop posts the events queued, waiting for them at most timeout
+func (r *EventRecorder) Stop(timeout time.Duration) {
+	r.lock.Lock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.queue)
+	}
+	r.lock.Unlock()
+
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+		log.Warn("Timeout posting events of DRBD kernel mods install")
+	}
+}
+
+func (r *EventRecorder) run() {
+	defer close(r.done)
+	for event := range r.queue {
+		for _, object := range r.Objects {
+			if err := r.post(object, event); err != nil {
+				log.WithError(err).WithFields(log.Fields{"stage": event.Stage, "object": object.Kind + "/" + object.Name}).Warn("Failed to post event")
+			}
+		}
+	}
+}
+
+func (r *EventRecorder) post(object ObjectReference, stageEvent drbd.StageEvent) error {
+	eventType, message := EventTypeNormal, ""
+	switch stageEvent.Phase {
+	case drbd.StageStarted:
+		message = fmt.Sprintf("Started %s", stageEvent.Description)
+	case drbd.StageSucceeded:
+		message = fmt.Sprintf("Finished %s", stageEvent.Description)
+	default:
+		eventType = EventTypeWarning
+		message = fmt.Sprintf("Failed %s: %s", stageEvent.Description, stageEvent.Error)
+	}
+	if len(message) > eventMessageMaxLength {
+		message = message[:eventMessageMaxLength-3] + "..."
+	}
+	reason := stageEvent.Stage + stageEvent.Phase
+	now := time.Now().UTC().Truncate(time.Second)
+
+	namespace := object.Namespace
+	if namespace == "" {
+		namespace = NodeEventNamespace
+	}
+	key := strings.Join([]string{object.Kind, namespace, object.Name, reason, message}, "/")
+	if event, exists := r.posted[key]; exists {
+		err := r.Client.PatchEvent(namespace, event.Metadata.Name, map[string]interface{}{
+			"count":         event.Count + 1,
+			"lastTimestamp": now,
+		})
+		if err == nil {
+			event.Count++
+			event.LastTimestamp = now
+			return nil
+		}
+		// the event expired, post it again
+		if !IsNotFound(err) {
+			return err
+		}
+		delete(r.posted, key)
+	}
+
+	event := &Event{
+		Metadata: ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", object.Name, time.Now().UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject:     object,
+		Reason:             reason,
+		Message:            message,
+		Type:               eventType,
+		Source:             EventSource{Component: EventComponent, Host: r.Host},
+		FirstTimestamp:     now,
+		LastTimestamp:      now,
+		Count:              1,
+		ReportingComponent: EventComponent,
+		ReportingInstance:  r.Host,
+	}
+	if err := r.Client.CreateEvent(namespace, event); err != nil {
+		return err
+	}
+	if len(r.posted) >= eventCacheSize {
+		r.posted = map[string]*Event{}
+	}
+	r.posted[key] = event
+	return nil
+}
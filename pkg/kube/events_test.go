@@ -0,0 +1,106 @@
+package kube
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hwameistor/drbd-installer/pkg/drbd"
+	"github.com/hwameistor/drbd-installer/pkg/exechelper"
+)
+
+func TestEventRecorderCollapsesRepeatedEvents(t *testing.T) {
+	server := newFakeAPIServer(t)
+	recorder := NewEventRecorder(NewClient(server.URL, "token", nil), "node-1", NodeReference("node-1"))
+
+	started := drbd.StageEvent{Stage: drbd.StageDepmod, Description: "generating DRBD kernel mods dependencies", Phase: drbd.StageStarted}
+	// every reconcile pass runs the same stages again
+	for pass := 0; pass < 3; pass++ {
+		recorder.Observe(started)
+	}
+	recorder.Observe(drbd.StageEvent{Stage: drbd.StageDepmod, Description: "generating DRBD kernel mods dependencies", Phase: drbd.StageSucceeded})
+	recorder.Stop(5 * time.Second)
+
+	requests := server.received()
+	if len(requests) != 4 {
+		t.Fatalf("received %d requests, want 4: %+v", len(requests), requests)
+	}
+
+	created := requests[0]
+	if created.Method != http.MethodPost || created.Path != "/api/v1/namespaces/default/events" {
+		t.Errorf("first request = %s %s, want POST of event", created.Method, created.Path)
+	}
+	if created.Body["reason"] != "DepmodStarted" || created.Body["type"] != EventTypeNormal || created.Body["count"] != float64(1) ||
+		created.Body["message"] != "Started generating DRBD kernel mods dependencies" {
+		t.Errorf("created event = %v", created.Body)
+	}
+	if object := created.Body["involvedObject"].(map[string]interface{}); object["kind"] != "Node" || object["name"] != "node-1" {
+		t.Errorf("involvedObject = %v", object)
+	}
+	name := created.Body["metadata"].(map[string]interface{})["name"].(string)
+
+	for idx, count := range []float64{2, 3} {
+		patch := requests[1+idx]
+		if patch.Method != http.MethodPatch || patch.Path != "/api/v1/namespaces/default/events/"+name || patch.ContentType != MergePatchType {
+			t.Errorf("repeated event request = %s %s %s, want merge patch of %s", patch.Method, patch.Path, patch.ContentType, name)
+		}
+		if patch.Body["count"] != count || patch.Body["lastTimestamp"] == nil {
+			t.Errorf("repeated event patch = %v, want count %g", patch.Body, count)
+		}
+	}
+
+	// another phase is another event
+	if finished := requests[3]; finished.Method != http.MethodPost || finished.Body["reason"] != "DepmodSucceeded" {
+		t.Errorf("last request = %s %v, want POST of DepmodSucceeded", finished.Method, finished.Body)
+	}
+}
+
+func TestEventRecorderTruncatesStderr(t *testing.T) {
+	server := newFakeAPIServer(t)
+	recorder := NewEventRecorder(NewClient(server.URL, "", nil), "node-1",
+		NodeReference("node-1"), PodReference("hwameistor", "drbd-installer-x7k2p", "uid-1"))
+
+	execRst := exechelper.ExecResult{
+		ErrBuf:   bytes.NewBufferString("depmod: ERROR: " + strings.Repeat("x", 2*eventMessageMaxLength)),
+		ExitCode: 1,
+		Error:    errors.New("exit status 1"),
+	}
+	err := &drbd.CommandError{Command: []string{"depmod"}, Err: execRst.Error, Stderr: execRst.ErrBuf.String()}
+	recorder.Observe(drbd.StageEvent{Stage: drbd.StageDepmod, Description: "generating DRBD kernel mods dependencies", Phase: drbd.StageFailed, Error: err.Error()})
+	recorder.Stop(5 * time.Second)
+
+	requests := server.received()
+	if len(requests) != 2 {
+		t.Fatalf("received %d requests, want one event per object: %+v", len(requests), requests)
+	}
+	if path := requests[1].Path; path != "/api/v1/namespaces/hwameistor/events" {
+		t.Errorf("event of pod posted to %s", path)
+	}
+	for _, request := range requests {
+		message := request.Body["message"].(string)
+		if len(message) != eventMessageMaxLength || !strings.HasSuffix(message, "...") {
+			t.Errorf("message of %d bytes %q..., want it truncated to %d", len(message), message[:40], eventMessageMaxLength)
+		}
+		if !strings.HasPrefix(message, "Failed generating DRBD kernel mods dependencies: exit status 1(depmod: ERROR: xxx") {
+			t.Errorf("message = %q..., want the stderr in it", message[:80])
+		}
+		if request.Body["type"] != EventTypeWarning || request.Body["reason"] != "DepmodFailed" {
+			t.Errorf("event = %v, want a DepmodFailed warning", request.Body)
+		}
+	}
+}
+
+func TestEventRecorderDropsAfterStop(t *testing.T) {
+	server := newFakeAPIServer(t)
+	recorder := NewEventRecorder(NewClient(server.URL, "", nil), "node-1", NodeReference("node-1"))
+	recorder.Stop(5 * time.Second)
+	recorder.Observe(drbd.StageEvent{Stage: drbd.StageDepmod, Phase: drbd.StageStarted})
+	recorder.Stop(5 * time.Second)
+
+	if requests := server.received(); len(requests) != 0 {
+		t.Errorf("received %d requests after Stop, want none", len(requests))
+	}
+}
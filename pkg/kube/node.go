@@ -0,0 +1,125 @@
+package kube
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/hwameistor/drbd-installer/pkg/drbd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	LabelPrefix = "drbd.hwameistor.io/"
+	// ReadyLabel is "true" if the DRBD kernel mods of the chosen build are
+	// loaded on the node, "false" otherwise
+	ReadyLabel = LabelPrefix + "ready"
+	// VersionLabel is the version of the loaded drbd, absent if none is
+	VersionLabel = LabelPrefix + "version"
+	// InstallAnnotation holds the NodeInstall of the last install run
+	InstallAnnotation = LabelPrefix + "install"
+
+	labelValueMaxLength = 63
+)
+
+// NodeInstall is what the last install run put on the node
+type NodeInstall struct {
+	Kernel      string `json:"kernel"`
+	Build       string `json:"build,omitempty"`
+	BuildDigest string `json:"buildDigest,omitempty"`
+	DRBDVersion string `json:"drbdVersion,omitempty"`
+}
+
+// NodeLabeler reflects the DRBD state of the node in its labels and
+// annotations, so schedulers and other components can select nodes with DRBD
+// ready
+type NodeLabeler struct {
+	Client   *Client
+	NodeName string
+
+	lock sync.Mutex
+	// last is the last patch applied, an equal one isn't sent again
+	last map[string]interface{}
+}
+
+func NewNodeLabeler(client *Client, nodeName string) *NodeLabeler {
+	return &NodeLabeler{Client: client, NodeName: nodeName}
+}
+
+// Observe patches the node with the result of a reconcile pass, it's
+// registered with drbd.Reconciler.AddObserver. Failures are only logged
+func (l *NodeLabeler) Observe(result *drbd.ReconcileResult) {
+	labels := map[string]interface{}{
+		ReadyLabel:   "false",
+		VersionLabel: nil,
+	}
+	if result.Ready {
+		labels[ReadyLabel] = "true"
+	}
+	if result.LoadedDRBDVersion != "" {
+		labels[VersionLabel] = labelValue(result.LoadedDRBDVersion)
+	}
+
+	annotations := map[string]interface{}{InstallAnnotation: nil}
+	if run := result.Run; run != nil {
+		data, err := json.Marshal(NodeInstall{
+			Kernel:      run.Kernel,
+			Build:       run.Build,
+			BuildDigest: run.BuildDigest,
+			DRBDVersion: run.DRBDVersion,
+		})
+		if err == nil {
+			annotations[InstallAnnotation] = string(data)
+		}
+	}
+
+	if err := l.patch(labels, annotations); err != nil {
+		log.WithError(err).WithField("node", l.NodeName).Warn("Failed to update DRBD labels of node")
+	}
+}
+
+// Remove removes the DRBD labels and annotations from the node, e.g. after
+// DRBD kernel mods are uninstalled
+func (l *NodeLabeler) Remove() error {
+	return l.patch(
+		map[string]interface{}{ReadyLabel: nil, VersionLabel: nil},
+		map[string]interface{}{InstallAnnotation: nil},
+	)
+}
+
+func (l *NodeLabeler) patch(labels, annotations map[string]interface{}) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if reflect.DeepEqual(patch, l.last) {
+		return nil
+	}
+	if err := l.Client.PatchNode(l.NodeName, patch); err != nil {
+		return err
+	}
+	l.last = patch
+	log.WithFields(log.Fields{"node": l.NodeName, "labels": labels}).Debug("DRBD labels of node updated")
+	return nil
+}
+
+// labelValue makes value a valid label value: at most 63 alphanumerics, '-',
+// '_' or '.', starting and ending with an alphanumeric
+func labelValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, value)
+	if len(value) > labelValueMaxLength {
+		value = value[:labelValueMaxLength]
+	}
+	return strings.Trim(value, "-_.")
+}
@@ -0,0 +1,151 @@
+package kube
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/hwameistor/drbd-installer/pkg/drbd"
+)
+
+func readyResult(version, kernel string) *drbd.ReconcileResult {
+	return &drbd.ReconcileResult{
+		Ready:             true,
+		LoadedDRBDVersion: version,
+		Run: &drbd.RunResult{
+			Kernel:      kernel,
+			Build:       kernel + "/amd64",
+			BuildDigest: "digest-" + kernel,
+			DRBDVersion: version,
+		},
+	}
+}
+
+// patchedMetadata returns the labels and annotations of a node patch
+func patchedMetadata(t *testing.T, req fakeRequest) (map[string]interface{}, map[string]interface{}) {
+	t.Helper()
+	if req.Method != http.MethodPatch || req.Path != "/api/v1/nodes/node-1" || req.ContentType != MergePatchType {
+		t.Fatalf("request = %s %s %s, want merge patch of node-1", req.Method, req.Path, req.ContentType)
+	}
+	metadata := req.Body["metadata"].(map[string]interface{})
+	return metadata["labels"].(map[string]interface{}), metadata["annotations"].(map[string]interface{})
+}
+
+func installAnnotation(t *testing.T, annotations map[string]interface{}) NodeInstall {
+	t.Helper()
+	var install NodeInstall
+	value, _ := annotations[InstallAnnotation].(string)
+	if err := json.Unmarshal([]byte(value), &install); err != nil {
+		t.Fatalf("annotation %s = %v, want NodeInstall JSON", InstallAnnotation, annotations[InstallAnnotation])
+	}
+	return install
+}
+
+func TestNodeLabelerObserve(t *testing.T) {
+	server := newFakeAPIServer(t)
+	labeler := NewNodeLabeler(NewClient(server.URL, "token", nil), "node-1")
+
+	labeler.Observe(readyResult("9.1.11", "4.18.0-348.el8.x86_64"))
+	requests := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	labels, annotations := patchedMetadata(t, requests[0])
+	if labels[ReadyLabel] != "true" || labels[VersionLabel] != "9.1.11" {
+		t.Errorf("labels = %v, want ready and version 9.1.11", labels)
+	}
+	install := installAnnotation(t, annotations)
+	if install.Kernel != "4.18.0-348.el8.x86_64" || install.BuildDigest != "digest-4.18.0-348.el8.x86_64" {
+		t.Errorf("install annotation = %+v", install)
+	}
+
+	// identical state isn't patched again
+	labeler.Observe(readyResult("9.1.11", "4.18.0-348.el8.x86_64"))
+	if len(server.received()) != 1 {
+		t.Fatalf("got %d requests, want identical state not re-patched", len(server.received()))
+	}
+
+	// a new version and kernel update the label and annotation
+	labeler.Observe(readyResult("9.2.4", "4.18.0-372.el8.x86_64"))
+	requests = server.received()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	labels, annotations = patchedMetadata(t, requests[1])
+	if labels[VersionLabel] != "9.2.4" {
+		t.Errorf("version label = %v, want 9.2.4", labels[VersionLabel])
+	}
+	if install := installAnnotation(t, annotations); install.Kernel != "4.18.0-372.el8.x86_64" || install.DRBDVersion != "9.2.4" {
+		t.Errorf("install annotation = %+v", install)
+	}
+
+	// failure flips ready and removes the version of drbd no longer loaded
+	labeler.Observe(&drbd.ReconcileResult{Ready: false, Run: &drbd.RunResult{Kernel: "4.18.0-372.el8.x86_64"}})
+	requests = server.received()
+	if len(requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(requests))
+	}
+	labels, _ = patchedMetadata(t, requests[2])
+	if labels[ReadyLabel] != "false" {
+		t.Errorf("ready label = %v, want false", labels[ReadyLabel])
+	}
+	if value, exists := labels[VersionLabel]; !exists || value != nil {
+		t.Errorf("version label = %v (exists %t), want null", value, exists)
+	}
+}
+
+func TestNodeLabelerObserveRetriesFailedPatch(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden} {
+		server := newFakeAPIServer(t)
+		labeler := NewNodeLabeler(NewClient(server.URL, "token", nil), "node-1")
+
+		server.reply(status, "denied")
+		labeler.Observe(readyResult("9.1.11", "5.14.0-70.el9.x86_64"))
+		server.reply(http.StatusOK, "")
+		labeler.Observe(readyResult("9.1.11", "5.14.0-70.el9.x86_64"))
+
+		if got := len(server.received()); got != 2 {
+			t.Errorf("status %d: got %d requests, want the failed patch sent again", status, got)
+		}
+	}
+}
+
+func TestNodeLabelerRemove(t *testing.T) {
+	server := newFakeAPIServer(t)
+	labeler := NewNodeLabeler(NewClient(server.URL, "token", nil), "node-1")
+
+	labeler.Observe(readyResult("9.1.11", "5.14.0-70.el9.x86_64"))
+	if err := labeler.Remove(); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	requests := server.received()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	labels, annotations := patchedMetadata(t, requests[1])
+	for _, name := range []string{ReadyLabel, VersionLabel} {
+		if value, exists := labels[name]; !exists || value != nil {
+			t.Errorf("label %s = %v (exists %t), want null", name, value, exists)
+		}
+	}
+	if value, exists := annotations[InstallAnnotation]; !exists || value != nil {
+		t.Errorf("annotation %s = %v (exists %t), want null", InstallAnnotation, value, exists)
+	}
+
+	server.reply(http.StatusForbidden, "denied")
+	if err := NewNodeLabeler(NewClient(server.URL, "token", nil), "node-1").Remove(); err == nil {
+		t.Error("Remove() error = nil, want the forbidden error")
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	for value, want := range map[string]string{
+		"9.1.11":      "9.1.11",
+		"9.2.0-rc.1+": "9.2.0-rc.1",
+		"+9.1":        "9.1",
+	} {
+		if got := labelValue(value); got != want {
+			t.Errorf("labelValue(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hwameistor/drbd-installer/pkg/drbd"
+)
+
+// ContentType is the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const namespace = "drbd_installer"
+
+// Collector turns the results of the reconciler into Prometheus metrics. It's
+// written out in the text exposition format by hand to keep the dependencies
+// of the installer small
+type Collector struct {
+	lock sync.Mutex
+
+	// lastRun is the last install run counted, a pass without a new run
+	// reuses it
+	lastRun *drbd.RunResult
+	last    *drbd.ReconcileResult
+
+	stageRuns     map[[2]string]float64
+	stageDuration map[string]float64
+	stageCount    map[string]float64
+	reconciles    map[string]float64
+	drift         map[string]float64
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		stageRuns:     map[[2]string]float64{},
+		stageDuration: map[string]float64{},
+		stageCount:    map[string]float64{},
+		reconciles:    map[string]float64{},
+		drift:         map[string]float64{},
+	}
+}
+
+// Observe counts the result of a reconcile pass, it's registered with
+// drbd.Reconciler.AddObserver
+func (c *Collector) Observe(result *drbd.ReconcileResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.last = result
+	c.reconciles[resultLabel(result.Success)]++
+	for _, drift := range result.Drift {
+		c.drift[drift.Kind]++
+	}
+
+	if result.Run == nil || result.Run == c.lastRun {
+		return
+	}
+	c.lastRun = result.Run
+	for _, stage := range result.Run.Stages {
+		c.stageRuns[[2]string{stage.Stage, resultLabel(stage.Success)}]++
+		c.stageDuration[stage.Stage] += stage.Duration.Seconds()
+		c.stageCount[stage.Stage]++
+	}
+}
+
+// ServeHTTP writes all metrics
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(c.expose())
+}
+
+func (c *Collector) expose() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	buf := &bytes.Buffer{}
+
+	family(buf, "stage_runs_total", "counter", "Runs of install pipeline stages by result")
+	for _, key := range sortedKeys2(c.stageRuns) {
+		sample(buf, "stage_runs_total", c.stageRuns[key], "stage", key[0], "result", key[1])
+	}
+
+	family(buf, "stage_duration_seconds", "summary", "Duration of install pipeline stages")
+	for _, stage := range sortedKeys(c.stageCount) {
+		sample(buf, "stage_duration_seconds_sum", c.stageDuration[stage], "stage", stage)
+		sample(buf, "stage_duration_seconds_count", c.stageCount[stage], "stage", stage)
+	}
+
+	family(buf, "reconciles_total", "counter", "Reconcile passes by result")
+	for _, result := range sortedKeys(c.reconciles) {
+		sample(buf, "reconciles_total", c.reconciles[result], "result", result)
+	}
+
+	family(buf, "reconcile_drift_total", "counter", "Drifts from the installed state found by reconcile passes, by kind")
+	for _, kind := range sortedKeys(c.drift) {
+		sample(buf, "reconcile_drift_total", c.drift[kind], "kind", kind)
+	}
+
+	if c.last == nil {
+		return buf.Bytes()
+	}
+
+	run := c.lastRun
+	if run != nil {
+		family(buf, "info", "gauge", "Running kernel, chosen build and loaded DRBD version")
+		sample(buf, "info", 1, "kernel", run.Kernel, "build", run.Build, "build_drbd_version", run.DRBDVersion, "loaded_drbd_version", c.last.LoadedDRBDVersion)
+
+		family(buf, "suitable_build", "gauge", "Whether a DRBD kernel mods build exists for the running and each installed kernel")
+		findBuild := run.Stage(drbd.StageFindBuild)
+		sample(buf, "suitable_build", boolValue(findBuild != nil && findBuild.Success), "kernel", run.Kernel, "running", "true")
+		for _, kernel := range run.InstalledKernels {
+			sample(buf, "suitable_build", boolValue(kernel.Build != ""), "kernel", kernel.Kernel, "running", "false")
+		}
+
+		family(buf, "upgrade_pending", "gauge", "Whether a new DRBD waits for a reboot to be loaded")
+		sample(buf, "upgrade_pending", boolValue(run.UpgradePending))
+
+		family(buf, "last_run_success", "gauge", "Whether the last install run succeeded")
+		sample(buf, "last_run_success", boolValue(run.Success))
+
+		family(buf, "last_run_timestamp_seconds", "gauge", "End time of the last install run")
+		sample(buf, "last_run_timestamp_seconds", float64(run.EndTime.UnixNano())/1e9)
+	}
+
+	family(buf, "ready", "gauge", "Whether the DRBD kernel mods of the chosen build are loaded")
+	sample(buf, "ready", boolValue(c.last.Ready))
+
+	family(buf, "reconcile_consecutive_failures", "gauge", "Consecutive failed reconcile passes")
+	sample(buf, "reconcile_consecutive_failures", float64(c.last.Failures))
+
+	return buf.Bytes()
+}
+
+func family(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s_%s %s\n", namespace, name, help)
+	fmt.Fprintf(buf, "# TYPE %s_%s %s\n", namespace, name, kind)
+}
+
+// labelEscaper applies the only escapes of label values the exposition format
+// knows: backslash, double quote and newline
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample writes a sample of name with labels given as name, value pairs
+func sample(buf *bytes.Buffer, name string, value float64, labels ...string) {
+	fmt.Fprintf(buf, "%s_%s", namespace, name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for idx := 0; idx+1 < len(labels); idx += 2 {
+			pairs = append(pairs, labels[idx]+`="`+labelEscaper.Replace(labels[idx+1])+`"`)
+		}
+		fmt.Fprintf(buf, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(buf, " %g\n", value)
+}
+
+func resultLabel(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys2(values map[[2]string]float64) [][2]string {
+	keys := make([][2]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a][0] != keys[b][0] {
+			return keys[a][0] < keys[b][0]
+		}
+		return keys[a][1] < keys[b][1]
+	})
+	return keys
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hwameistor/drbd-installer/pkg/drbd"
+)
+
+func TestSampleEscapesLabels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sample(buf, "info", 1, "kernel", "a\\b\"c\nd\x7f \U0001f600", "build", "")
+
+	want := "drbd_installer_info{kernel=\"a\\\\b\\\"c\\nd\x7f \U0001f600\",build=\"\"} 1\n"
+	if buf.String() != want {
+		t.Errorf("sample() = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestCollectorServeHTTP(t *testing.T) {
+	run := &drbd.RunResult{
+		EndTime:     time.Unix(1700000000, 0),
+		Kernel:      "3.10.0-1160.83.1.el7.x86_64",
+		Build:       "3.10.0-1160.el7.x86_64/amd64",
+		DRBDVersion: "9.0.22-2",
+		Stages: []drbd.StageResult{
+			{Stage: drbd.StageFindBuild, Success: true, Duration: 500 * time.Millisecond},
+			{Stage: drbd.StageCopy, Success: false, Duration: 2 * time.Second},
+		},
+	}
+	collector := NewCollector()
+	collector.Observe(&drbd.ReconcileResult{
+		Run:               run,
+		Drift:             []drbd.Drift{{Kind: "files", Detail: "drbd.ko is missing"}},
+		LoadedDRBDVersion: "8.4.11",
+		Failures:          1,
+	})
+	// a pass reusing the run doesn't count its stages again
+	collector.Observe(&drbd.ReconcileResult{Run: run, Success: true, Ready: true, LoadedDRBDVersion: "9.0.22-2"})
+
+	recorder := httptest.NewRecorder()
+	collector.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != ContentType {
+		t.Errorf("Content-Type = %s, want %s", contentType, ContentType)
+	}
+
+	want := strings.Join([]string{
+		`# HELP drbd_installer_stage_runs_total Runs of install pipeline stages by result`,
+		`# TYPE drbd_installer_stage_runs_total counter`,
+		`drbd_installer_stage_runs_total{stage="CopyKernelModToHost",result="failure"} 1`,
+		`drbd_installer_stage_runs_total{stage="HasSuitableDRBDKernelModBuilds",result="success"} 1`,
+		`# HELP drbd_installer_stage_duration_seconds Duration of install pipeline stages`,
+		`# TYPE drbd_installer_stage_duration_seconds summary`,
+		`drbd_installer_stage_duration_seconds_sum{stage="CopyKernelModToHost"} 2`,
+		`drbd_installer_stage_duration_seconds_count{stage="CopyKernelModToHost"} 1`,
+		`drbd_installer_stage_duration_seconds_sum{stage="HasSuitableDRBDKernelModBuilds"} 0.5`,
+		`drbd_installer_stage_duration_seconds_count{stage="HasSuitableDRBDKernelModBuilds"} 1`,
+		`# HELP drbd_installer_reconciles_total Reconcile passes by result`,
+		`# TYPE drbd_installer_reconciles_total counter`,
+		`drbd_installer_reconciles_total{result="failure"} 1`,
+		`drbd_installer_reconciles_total{result="success"} 1`,
+		`# HELP drbd_installer_reconcile_drift_total Drifts from the installed state found by reconcile passes, by kind`,
+		`# TYPE drbd_installer_reconcile_drift_total counter`,
+		`drbd_installer_reconcile_drift_total{kind="files"} 1`,
+		`# HELP drbd_installer_info Running kernel, chosen build and loaded DRBD version`,
+		`# TYPE drbd_installer_info gauge`,
+		`drbd_installer_info{kernel="3.10.0-1160.83.1.el7.x86_64",build="3.10.0-1160.el7.x86_64/amd64",build_drbd_version="9.0.22-2",loaded_drbd_version="9.0.22-2"} 1`,
+		`# HELP drbd_installer_suitable_build Whether a DRBD kernel mods build exists for the running and each installed kernel`,
+		`# TYPE drbd_installer_suitable_build gauge`,
+		`drbd_installer_suitable_build{kernel="3.10.0-1160.83.1.el7.x86_64",running="true"} 1`,
+		`# HELP drbd_installer_upgrade_pending Whether a new DRBD waits for a reboot to be loaded`,
+		`# TYPE drbd_installer_upgrade_pending gauge`,
+		`drbd_installer_upgrade_pending 0`,
+		`# HELP drbd_installer_last_run_success Whether the last install run succeeded`,
+		`# TYPE drbd_installer_last_run_success gauge`,
+		`drbd_installer_last_run_success 0`,
+		`# HELP drbd_installer_last_run_timestamp_seconds End time of the last install run`,
+		`# TYPE drbd_installer_last_run_timestamp_seconds gauge`,
+		`drbd_installer_last_run_timestamp_seconds 1.7e+09`,
+		`# HELP drbd_installer_ready Whether the DRBD kernel mods of the chosen build are loaded`,
+		`# TYPE drbd_installer_ready gauge`,
+		`drbd_installer_ready 1`,
+		`# HELP drbd_installer_reconcile_consecutive_failures Consecutive failed reconcile passes`,
+		`# TYPE drbd_installer_reconcile_consecutive_failures gauge`,
+		`drbd_installer_reconcile_consecutive_failures 0`,
+	}, "\n") + "\n"
+	if got := recorder.Body.String(); got != want {
+		t.Errorf("metrics = \n%s\nwant\n%s", got, want)
+	}
+}
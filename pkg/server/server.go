@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hwameistor/drbd-installer/pkg/drbd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+	StatusPath  = "/status"
+	MetricsPath = "/metrics"
+)
+
+// Reconciler provides the result of the last reconcile pass, it's usually a
+// *drbd.Reconciler
+type Reconciler interface {
+	Last() *drbd.ReconcileResult
+}
+
+// Server exposes the health, readiness, the last reconcile result and the
+// metrics of the installer over HTTP, for probes, dependent pods and scrapers
+type Server struct {
+	reconciler Reconciler
+	server     *http.Server
+}
+
+func New(addr string, reconciler Reconciler, metrics http.Handler) *Server {
+	s := &Server{reconciler: reconciler}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(HealthzPath, s.healthz)
+	mux.HandleFunc(ReadyzPath, s.readyz)
+	mux.HandleFunc(StatusPath, s.status)
+	mux.Handle(MetricsPath, metrics)
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Start serves in background until Shutdown
+func (s *Server) Start() {
+	go func() {
+		log.Infof("start serving HTTP on %s", s.server.Addr)
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Failed to serve HTTP")
+		}
+	}()
+}
+
+// Shutdown stops serving, waiting for requests in progress until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// healthz reports the process is alive
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyz reports whether the DRBD kernel mods of the chosen build are loaded
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	last := s.reconciler.Last()
+	switch {
+	case last == nil:
+		http.Error(w, "installer has not run yet", http.StatusServiceUnavailable)
+	case !last.Ready:
+		http.Error(w, last.NotReadyReason, http.StatusServiceUnavailable)
+	default:
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// status returns the last reconcile result, with the last install run, as JSON
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	last := s.reconciler.Last()
+	if last == nil {
+		http.Error(w, "installer has not run yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	data, err := json.MarshalIndent(last, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hwameistor/drbd-installer/pkg/drbd"
+)
+
+// fakeReconciler stands for the reconcile loop, whose passes set the last
+// result
+type fakeReconciler struct {
+	lock sync.Mutex
+	last *drbd.ReconcileResult
+}
+
+func (r *fakeReconciler) Last() *drbd.ReconcileResult {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.last
+}
+
+func (r *fakeReconciler) pass(result *drbd.ReconcileResult) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.last = result
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestReadyz(t *testing.T) {
+	reconciler := &fakeReconciler{}
+	s := New("", reconciler, http.NotFoundHandler())
+	ts := httptest.NewServer(s.server.Handler)
+	defer ts.Close()
+
+	for _, step := range []struct {
+		name   string
+		result *drbd.ReconcileResult
+		code   int
+		body   string
+	}{
+		{"before the first pass", nil, http.StatusServiceUnavailable, "installer has not run yet"},
+		{"drbd not loaded", &drbd.ReconcileResult{NotReadyReason: "drbd not loaded"}, http.StatusServiceUnavailable, "drbd not loaded"},
+		{"drbd loaded", &drbd.ReconcileResult{Ready: true}, http.StatusOK, "ok"},
+		{"upgrade pending", &drbd.ReconcileResult{NotReadyReason: "upgrade to DRBD 9.0.22-2 pending until reboot"}, http.StatusServiceUnavailable, "pending until reboot"},
+		{"drbd loaded again", &drbd.ReconcileResult{Ready: true}, http.StatusOK, "ok"},
+	} {
+		reconciler.pass(step.result)
+		code, body := get(t, ts.URL+ReadyzPath)
+		if code != step.code || !strings.Contains(body, step.body) {
+			t.Errorf("%s: readyz = %d %q, want %d %q", step.name, code, body, step.code, step.body)
+		}
+		if code, _ := get(t, ts.URL+HealthzPath); code != http.StatusOK {
+			t.Errorf("%s: healthz = %d, want %d", step.name, code, http.StatusOK)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	reconciler := &fakeReconciler{}
+	s := New("", reconciler, http.NotFoundHandler())
+	ts := httptest.NewServer(s.server.Handler)
+	defer ts.Close()
+
+	if code, _ := get(t, ts.URL+StatusPath); code != http.StatusServiceUnavailable {
+		t.Errorf("status before the first pass = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	reconciler.pass(&drbd.ReconcileResult{
+		Ready:   true,
+		Success: true,
+		Run:     &drbd.RunResult{Kernel: "3.10.0-1160.el7.x86_64", Success: true},
+	})
+	code, body := get(t, ts.URL+StatusPath)
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var result drbd.ReconcileResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatalf("status is not JSON: %v", err)
+	}
+	if !result.Ready || result.Run == nil || result.Run.Kernel != "3.10.0-1160.el7.x86_64" {
+		t.Errorf("status = %+v", result)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	s := New(addr, &fakeReconciler{}, http.NotFoundHandler())
+	s.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + HealthzPath)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not serving on %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if resp, err := http.Get("http://" + addr + HealthzPath); err == nil {
+		resp.Body.Close()
+		t.Error("server still serving after Shutdown")
+	}
+}